@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var (
+	errNotJSON   = errors.New("not a JSON object or array")
+	errNotLogfmt = errors.New("no key=value pairs")
+)
+
+// parseJSON parses text as a JSON object or array. Numbers are kept as
+// json.Number, such that they are output as written.
+func parseJSON(text string) (interface{}, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasPrefix(text, "{") && !strings.HasPrefix(text, "[") {
+		return nil, errNotJSON
+	}
+	d := json.NewDecoder(strings.NewReader(text))
+	d.UseNumber()
+	var v interface{}
+	if err := d.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// lookupJSON looks up a path of object keys and array indices, separated by
+// dots, e.g., ".http.status" or ".items.0.id", in v.
+func lookupJSON(v interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(path, ".")
+	if path == "" {
+		return v, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch vv := v.(type) {
+		case map[string]interface{}:
+			var ok bool
+			if v, ok = vv[key]; !ok {
+				return nil, false
+			}
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(vv) {
+				return nil, false
+			}
+			v = vv[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+// formatJSON formats a JSON value for output: strings and numbers as they are,
+// and objects and arrays as compact JSON.
+func formatJSON(v interface{}) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		return strconv.FormatBool(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		return string(b)
+	}
+}
+
+// parseLogfmt parses the key=value pairs of text, as written by logfmt-style
+// loggers, e.g., at=info path="/a b" status=200, into a map. Quoted values may
+// contain Go escape sequences. Words that are not key=value pairs are skipped,
+// and the first of duplicate keys wins.
+func parseLogfmt(text string) (interface{}, error) {
+	fields := make(map[string]string)
+	for s := text; ; {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			break
+		}
+		i := strings.IndexAny(s, "= \t")
+		if i == 0 {
+			// A stray '='.
+			s = s[1:]
+			continue
+		}
+		if i < 0 {
+			break
+		}
+		key := s[:i]
+		if s = s[i:]; s[0] != '=' {
+			continue
+		}
+		s = s[1:]
+
+		var val string
+		if strings.HasPrefix(s, `"`) {
+			end := closingQuote(s)
+			if end < 0 {
+				// Unterminated, so take the rest of the line.
+				val, s = s[1:], ""
+			} else {
+				var err error
+				if val, err = strconv.Unquote(s[:end+1]); err != nil {
+					val = s[1:end]
+				}
+				s = s[end+1:]
+			}
+		} else {
+			j := strings.IndexAny(s, " \t")
+			if j < 0 {
+				j = len(s)
+			}
+			val, s = s[:j], s[j:]
+		}
+		if _, ok := fields[key]; !ok {
+			fields[key] = val
+		}
+	}
+	if len(fields) == 0 {
+		return nil, errNotLogfmt
+	}
+	return fields, nil
+}
+
+// closingQuote returns the index of the double quote that closes the one s
+// starts with, skipping escaped ones, or -1 if there is none.
+func closingQuote(s string) int {
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestJSONPlaceholder(t *testing.T) {
+	tmpl, err := newTemplate("test", `{json .msg '{text}'}|{json .http.status -}|{json .tags}|{json .tags.1}|{json .n null}|{json .ok}`, defaultPlaceholders())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ in, out string }{
+		{
+			`{"msg":"hi there","http":{"status":200},"tags":["a","b"],"n":null,"ok":true}`,
+			`hi there|200|["a","b"]|b|null|true`,
+		},
+		{
+			`  {"msg": "x", "http": {"status": 1.50}}`,
+			`x|1.50|||null|`,
+		},
+		{
+			`not json`,
+			`not json|-|||null|`,
+		},
+		{
+			`{"msg": "truncated`,
+			`{"msg": "truncated|-|||null|`,
+		},
+		{
+			`["a"]`,
+			`["a"]|-|||null|`,
+		},
+	} {
+		got, err := tmpl.renderString(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.out != got {
+			t.Errorf("%q: -%q +%q", tc.in, tc.out, got)
+		}
+	}
+}
+
+func TestParseLogfmt(t *testing.T) {
+	for _, tc := range []struct {
+		in     string
+		fields map[string]string
+	}{
+		{
+			`time=2021-02-16T12:00:00Z level=INFO msg="hello \"world\"\tx" count=3`,
+			map[string]string{"time": "2021-02-16T12:00:00Z", "level": "INFO", "msg": "hello \"world\"\tx", "count": "3"},
+		},
+		{
+			`at=info method=GET path="/a b" fwd="1.2.3.4" status=200`,
+			map[string]string{"at": "info", "method": "GET", "path": "/a b", "fwd": "1.2.3.4", "status": "200"},
+		},
+		{
+			`prefix: a=1 bare b= = a=2 c="unterminated \" x`,
+			map[string]string{"a": "1", "b": "", "c": `unterminated \" x`},
+		},
+		{
+			`k="bad \q escape"`,
+			map[string]string{"k": `bad \q escape`},
+		},
+		{`just some prose`, nil},
+		{``, nil},
+	} {
+		v, err := parseLogfmt(tc.in)
+		if tc.fields == nil {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %q", tc.in, v)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.fields, v) {
+			t.Errorf("%q:\n -%q\n +%q", tc.in, tc.fields, v)
+		}
+	}
+}
+
+func TestKVPlaceholder(t *testing.T) {
+	tmpl, err := newTemplate("test", `{kv msg '{text}'}|{kv status -}`, defaultPlaceholders())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ in, out string }{
+		{`level=WARN msg="disk full" status=507`, `disk full|507`},
+		{`plain text`, `plain text|-`},
+	} {
+		got, err := tmpl.renderString(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.out != got {
+			t.Errorf("%q: -%q +%q", tc.in, tc.out, got)
+		}
+	}
+}
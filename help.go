@@ -38,14 +38,57 @@ Usage:
     {{.app}} [OPTIONS] <command> [arguments...]
     <command> | {{.app}} [OPTIONS]
     <command> | {{.app}} [OPTIONS] <command> [arguments...]
+    {{.app}} [OPTIONS] --multi <[name=]command>...
 
 Options:
     -1, --stdout TEMPLATE  Set the standard output template ('' to discard the stream).
     -2, --stderr TEMPLATE  Set the standard error template (same as above).
-    -f, --file FILE        Log both output streams to FILE.
+    -f, --file FILE        Log both output streams to FILE (may contain placeholders).
     -s, --max-size SIZE    Limit the size of FILE to SIZE (e.g., 100kb, 1M, 1Gb, 32b).
     -c, --max-count COUNT  Limit the number of logfiles to COUNT.
+    --max-age DURATION     Drop rotated logfiles older than DURATION (e.g., 12h, 14d, 2w).
+    --max-total SIZE       Limit the total size of rotated logfiles to SIZE.
+    -r, --rotate-every INTERVAL
+                           Rotate FILE hourly, daily, weekly, or every INTERVAL (e.g., 30m, 12h, 2d).
+    -z, --compress METHOD  Compress rotated logfiles using METHOD (currently only "gzip").
+    --suffix-format FORMAT Name rotated logfiles by "index" (default) or "date".
+    --stdout-file FILE     Log the standard output stream to FILE.
+    --stderr-file FILE     Log the standard error stream to FILE.
+    --stdout-max-size SIZE, --stdout-max-count COUNT
+    --stderr-max-size SIZE, --stderr-max-count COUNT
+                           Override the size and count limits of the stream logfiles.
+    --file-format FORMAT   Write logfiles as "text" (default), or "json" or "logfmt" records.
+    --start-template TEMPLATE, --finish-template TEMPLATE, --rotate-template TEMPLATE
+                           Set the templates of the notices written to logfiles, or disable them
+                           if empty (e.g., --start-template=).
+    --level LEVEL=REGEXP   Classify lines matching REGEXP as LEVEL (ERROR, WARN, INFO, DEBUG or TRACE)
+                           for {level} and {levelcolor}. May be repeated.
     -n, --name NAME        Replace the default session name with NAME.
+    --pty                  Run the command on a pseudo-terminal (Linux only). Both output
+                           streams are then merged and rendered using the --stdout template.
+    --timeout DURATION     Terminate the command if it runs for longer than DURATION (see below).
+    --forward SIGNALS      Forward SIGNALS (e.g., "HUP,USR1") to the command as-is, which can be
+                           any of HUP, USR1, USR2, WINCH, CONT and TSTP.
+    --grace DURATION       Wait DURATION for the command to exit after SIGTERM or SIGQUIT
+                           before killing it (default: 3s).
+    --interrupt-window DURATION
+                           Send SIGTERM if interrupted twice within DURATION (default: 2s).
+    --group                Run the command in a process group of its own, and signal the whole group.
+    --drain-timeout DURATION
+                           Once the command exits, wait no longer than DURATION for its output
+                           streams to be closed by the processes it left behind, which are
+                           killed if --group is also specified (default: 1s with --group,
+                           otherwise 0, i.e., wait).
+    --restart MODE         Restart the command once it exits: "on-failure", "always" or "never" (default).
+    --max-restarts COUNT   Give up after COUNT consecutive restarts (default: 0, i.e., never).
+    --restart-delay DURATION
+                           Wait DURATION before restarting, doubling it each time up to 1m (default: 1s).
+    --restart-window DURATION
+                           Reset the delay and restart count once the command runs for DURATION (default: 1m).
+    --multi                Run each of the given commands concurrently, as a session of its own,
+                           named "name" if given as "name=command", and told apart by color.
+                           All sessions share the terminal and logfiles.
+    --kill-others          Terminate all sessions once one of them exits (--multi only).
     -q, --quiet            Don't echo anything, but log to FILE if requested.
     -a, --ansi STREAMS     Allow ANSI escape sequences on STREAMS, which can be any
                            combination of the characters '1', '2' and 'f' (default: 12),
@@ -60,9 +103,16 @@ Environment:
     {{.app | upcase }}_STDOUT     Sets the --stdout option.
     {{.app | upcase }}_STDERR     Sets the --stderr option.
     {{.app | upcase }}_TIMESTAMP  Overrides the default timestamp ({{ .timestamp }}).
+    {{.app | upcase }}_COLORS     Limits the number of colors available (see --help colors).
 
     Note that flags set via environment variables are reset by their
-    command-line equivalents.`
+    command-line equivalents.
+
+Exit status:
+    {{.app}} exits with the exit status of the command, or 128 plus the signal number
+    if the command was killed by a signal, and with 1 if it fails on its own.
+    If {{.app}} terminates the command because of --timeout, sending it SIGTERM and
+    then SIGKILL if it fails to exit within the --grace period, it exits with 124.`
 	fns := gotemplate.FuncMap{
 		"upcase": strings.ToUpper,
 	}
@@ -135,12 +185,73 @@ logfile when the given size limit is reached. Note that {{.app}} always writes o
 whole lines, which can force truncation prior to the size limit being reached
 if the line doesn't fit within the remaining space.
 
-If {{flag "max-count"}} is specified alongside {{flag "max-size"}} and the size limit is reached,
-{{.app}} will rename the main logfile to <logfile>.<suffix> and create an empty file
-under the initial name. Logfiles are ordered by age, newest to oldest (0 to {{flag "max-count"}}).
+If {{flag "rotate-every"}} is specified, the logfile is also truncated whenever a
+wall-clock boundary is crossed: at the start of every hour, day (midnight) or week
+(Monday), or every INTERVAL otherwise, counted from local midnight. INTERVALs of a
+day or longer are rounded to whole days. Empty logfiles are left alone, and a logfile
+last written to before the current interval is turned over on the first write.
+Both {{flag "max-size"}} and {{flag "rotate-every"}} may be used together, in which case
+whichever limit is reached first applies.
+
+If {{flag "max-count"}} is specified alongside {{flag "max-size"}} or {{flag "rotate-every"}} and a
+limit is reached, {{.app}} will rename the main logfile to <logfile>.<suffix> and create
+an empty file under the initial name. Logfiles are ordered by age, newest to oldest (0 to {{flag "max-count"}}).
 Note that {{.app}} assumes ownership of all files that match <logfile>.<suffix>, and
 attempts to keep them ordered even when the order is altered by external actions.
 
+Rotated logfiles can also be dropped based on their age or size: {{flag "max-age"}} drops
+those last written to (or, for dated suffixes, rotated) more than DURATION ago, while
+{{flag "max-total"}} keeps the newest logfiles whose combined size does not exceed SIZE.
+These limits are enforced at startup and after every rotation, and may be combined
+with {{flag "max-count"}} or used instead of it.
+
+If {{flag "suffix-format"}} is set to "date", rotated logfiles are instead named after the
+time of their rotation, e.g., <logfile>.2021-02-16T12-00-00, and are never renamed
+afterwards. {{flag "max-count"}} then drops the oldest logfiles by their timestamp.
+
+If {{flag "compress"}} is specified, rotated logfiles are compressed in the background,
+such that <logfile>.0 becomes <logfile>.0.gz, and are kept in order alongside
+uncompressed ones.
+
+Logfile paths may contain placeholders, e.g., {{flag "file"}} 'logs/{name}-{ts 2006-01-02}.log',
+which are rendered when the logfile is opened and again each time it is turned over,
+creating parent directories as needed. If the rendered path changes on rotation, the
+old logfile is left as is and logging carries on under the new path. Paths that use
+placeholders without a value when the logfile is first opened, such as {pid}, are
+rejected. Any slashes in rendered values (e.g., those of {ts date}) are replaced with
+dashes, such that they don't introduce directories of their own.
+
+If the logfile is moved or deleted while {{.app}} is running (e.g., by logrotate), it is
+reopened under its original name, and a SIGHUP forces the same. This makes {{.app}}
+usable with existing logrotate configurations, without any of the options above.
+
+Each output stream can also be logged to a file of its own, using {{flag "stdout-file"}}
+and {{flag "stderr-file"}}, in addition to or instead of the combined {{flag "file"}}. Stream
+logfiles are rotated independently, using the options above, except for the size and
+count limits, which can be set separately via {{flag "stdout-max-size"}}, {{flag "stdout-max-count"}},
+{{flag "stderr-max-size"}} and {{flag "stderr-max-count"}}, and default to {{flag "max-size"}} and
+{{flag "max-count"}}, respectively.
+
+Logfiles are marked with a notice when {{.app}} starts and finishes writing to them,
+and when they are turned over. These notices are templates, set via {{flag "start-template"}},
+{{flag "finish-template"}} and {{flag "rotate-template"}}, respectively, and are disabled if set
+to the empty string, as in {{flag "finish-template"}}=. Use that form in {{.app | upcase}}_OPTS,
+where empty quotes are dropped. The finish and start notices also mark each restart of the
+command, and the exit of each {{flag "multi"}} session. Besides the usual placeholders, {exit},
+{elapsed}, {bytes}, {lines} and {restarts} are useful in this context. By default, the finish
+notice reads:
+
+    {{.finish}}
+
+If {{flag "file-format"}} is set to "json" or "logfmt", logfiles are made up of records,
+one per line, instead of the rendered templates: JSON objects or key=value pairs,
+respectively, with values quoted as needed. Each record carries the timestamp ("ts"),
+the stream the line originates from ("stream": stdout, stderr or {{.app}} for notices),
+the session name ("name"), the process ID of the command ("pid"), a sequence number
+("seq") and the line itself, stripped of ANSI escape sequences ("msg"). Notices
+default to their message alone, without the timestamp and {{.app}} prefix. The
+output of the terminal is still governed by the templates.
+
 If the {{flag "ansi"}} flag does not include the letter 'f' (defaults to '12'), ANSI codes
 will not be written to logfiles.
 	`
@@ -148,9 +259,11 @@ will not be written to logfiles.
 		"bold":   bold,
 		"italic": italic,
 		"flag":   func(s string) string { return bold("--" + s) },
+		"upcase": strings.ToUpper,
 	}
 	data := map[string]string{
-		"app": app,
+		"app":    app,
+		"finish": defaultFinishTemplate,
 	}
 	return renderHelp("logfiles", s, fns, data)
 }
@@ -186,5 +299,26 @@ func helpPlaceholder(p string) string {
 }
 
 func helpColors() string {
-	return strings.Join(codes.keys("bg"), "\n")
+	s := `
+Colors, as accepted by {fg} and {bg}, are given either by name, which is any of:
+
+{{range .names}}    {{.}}
+{{end}}
+or by index in the 256-color palette, e.g., {fg 208 text}, or by RGB value, as
+#rgb, #rrggbb or rgb(r,g,b), e.g., {fg #ff8800 text} or {bg rgb(10,20,30) text}.
+
+Indexed and RGB colors are emitted as given, unless {{.env}} limits them to "16",
+"256" or "truecolor" colors, in which case they are replaced by the closest ones
+available. If set to "auto", the limit is taken from the COLORTERM ("truecolor" or
+"24bit" for RGB colors) and TERM ("*-256color" for indexed colors) environment
+variables, falling back to the 16 named colors.
+
+Finally, "auto" picks a color from a hash of the text, e.g., {fg auto {name}}, out
+of the colors available, or those the terminal supports if {{.env}} is unset.
+	`
+	data := map[string]interface{}{
+		"names": codes.keys("bg"),
+		"env":   colorsEnvVar,
+	}
+	return renderHelp("colors", s, nil, data)
 }
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/pborman/ansi"
+)
+
+// Log levels, as output by {level}.
+const (
+	levelError = "ERROR"
+	levelWarn  = "WARN"
+	levelInfo  = "INFO"
+	levelDebug = "DEBUG"
+	levelTrace = "TRACE"
+)
+
+// levelNames maps the names that log levels commonly go by, in lowercase, to
+// the levels above.
+var levelNames = map[string]string{
+	"panic":    levelError,
+	"fatal":    levelError,
+	"critical": levelError,
+	"crit":     levelError,
+	"error":    levelError,
+	"err":      levelError,
+	"warning":  levelWarn,
+	"warn":     levelWarn,
+	"notice":   levelInfo,
+	"info":     levelInfo,
+	"debug":    levelDebug,
+	"dbg":      levelDebug,
+	"trace":    levelTrace,
+}
+
+// glogLevels maps the letters that glog-style prefixes start with, in
+// lowercase, to the levels above.
+var glogLevels = map[string]string{
+	"f": levelError,
+	"e": levelError,
+	"w": levelWarn,
+	"i": levelInfo,
+}
+
+var levelColors = map[string]string{
+	levelError: "red",
+	levelWarn:  "yellow",
+	levelInfo:  "green",
+	levelDebug: "blue",
+	levelTrace: "dark-gray",
+}
+
+// levelRule classifies lines that match re as being of the given level.
+type levelRule struct {
+	level string
+	re    *regexp.Regexp
+}
+
+// levelPattern captures the name of a level in the first group of re, which
+// is looked up in names.
+type levelPattern struct {
+	re    *regexp.Regexp
+	names map[string]string
+}
+
+// defaultLevelPatterns are tried in order, after any user-supplied rules. The
+// next match is tried if the name captured by a pattern is not a level.
+var defaultLevelPatterns = []levelPattern{
+	// JSON fields, e.g., "level":"warn".
+	{regexp.MustCompile(`"(?i:level|lvl|severity)"\s*:\s*"(\w+)"`), levelNames},
+	// key=value pairs, e.g., level=warn or lvl="warn".
+	{regexp.MustCompile(`\b(?i:level|lvl|severity)="?(\w+)`), levelNames},
+	// Bracketed levels, e.g., [WARN].
+	{regexp.MustCompile(`\[(\w+)\]`), levelNames},
+	// glog-style prefixes, e.g., W1016 12:00:00.000000.
+	{regexp.MustCompile(`^([IWEF])\d{4} `), glogLevels},
+	// Uppercase words, e.g., 2021/01/01 WARN: ...
+	{regexp.MustCompile(`\b(PANIC|FATAL|CRITICAL|ERROR|WARNING|WARN|INFO|DEBUG|TRACE)\b`), levelNames},
+}
+
+// detectLevel returns the log level of text, or the empty string if none is
+// detected.
+func detectLevel(text string, rules []levelRule) string {
+	if b, err := ansi.Strip([]byte(text)); err == nil {
+		text = string(b)
+	}
+	for _, r := range rules {
+		if r.re.MatchString(text) {
+			return r.level
+		}
+	}
+	for _, p := range defaultLevelPatterns {
+		for _, m := range p.re.FindAllStringSubmatch(text, -1) {
+			if level, ok := p.names[strings.ToLower(m[1])]; ok {
+				return level
+			}
+		}
+	}
+	return ""
+}
+
+// levelPlaceholders creates the {level} and {levelcolor} placeholders, which
+// try rules before the default patterns. The level is detected once per line.
+func levelPlaceholders(rules []levelRule) (level, levelcolor placeholder) {
+	detect := func(l *line) string {
+		v, _ := l.parse("level", func(text string) (interface{}, error) {
+			return detectLevel(text, rules), nil
+		})
+		return v.(string)
+	}
+	level = linePlaceholder(func(l *line, args []string) (string, error) {
+		if level := detect(l); level != "" {
+			return level, nil
+		}
+		return strings.Join(args, " "), nil
+	})
+	levelcolor = linePlaceholder(func(l *line, args []string) (string, error) {
+		text := strings.Join(args, " ")
+		if c, ok := levelColors[detect(l)]; ok {
+			return codes["fg"][c].wrap(text), nil
+		}
+		return text, nil
+	})
+	return
+}
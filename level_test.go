@@ -0,0 +1,63 @@
+package main
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestDetectLevel(t *testing.T) {
+	rules := []levelRule{
+		{levelTrace, regexp.MustCompile(`^progress`)},
+		{levelWarn, regexp.MustCompile(`deprecated`)},
+	}
+	for _, tc := range []struct {
+		text  string
+		level string
+	}{
+		{`level=warn msg="x"`, levelWarn},
+		{`time=now lvl="ERROR" msg="x"`, levelError},
+		{`{"level":"debug","msg":"x"}`, levelDebug},
+		{`{"severity": "critical"}`, levelError},
+		{`[INFO] starting`, levelInfo},
+		{`[web] [warning] disk space`, levelWarn},
+		{`E1016 12:00:00.000000 1 main.go:1] boom`, levelError},
+		{`I1016 12:00:00.000000 1 main.go:1] ok`, levelInfo},
+		{`2021/01/01 12:00:00 TRACE entering`, levelTrace},
+		{"\033[31mFATAL\033[m: exiting", levelError},
+		{`progress: 50% [ERROR]`, levelTrace},
+		{`using a deprecated option`, levelWarn},
+		{`errors are lowercase here`, ""},
+		{`[web] listening`, ""},
+		{`for arr[i] in x[e]`, ""},
+		{`level=w msg="x"`, ""},
+		{``, ""},
+	} {
+		if got := detectLevel(tc.text, rules); tc.level != got {
+			t.Errorf("%q: -%q +%q", tc.text, tc.level, got)
+		}
+	}
+}
+
+func TestLevelPlaceholders(t *testing.T) {
+	ps := defaultPlaceholders()
+	level, levelcolor := levelPlaceholders([]levelRule{{levelDebug, regexp.MustCompile(`^dbg:`)}})
+	ps.set("level", level)
+	ps.set("levelcolor", levelcolor)
+	tmpl, err := newTemplate("test", `{level -}|{levelcolor {text}}`, ps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct{ in, out string }{
+		{"level=error x", "ERROR|\033[31mlevel=error x\033[m"},
+		{"dbg: x", "DEBUG|\033[34mdbg: x\033[m"},
+		{"plain", "-|plain"},
+	} {
+		got, err := tmpl.renderString(tc.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tc.out != got {
+			t.Errorf("%q: -%q +%q", tc.in, tc.out, got)
+		}
+	}
+}
@@ -11,10 +11,14 @@ import (
 	"os/exec"
 	"os/signal"
 	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/buildkite/shellwords"
 )
@@ -28,9 +32,14 @@ func main() {
 	if isPipe(os.Stdin) {
 		stdin = os.Stdin
 	}
-	switch err := invoke(stdin, os.Stdout, os.Stderr, os.Args[1:]).(type) {
+	err := invoke(stdin, os.Stdout, os.Stderr, os.Args[1:])
+	switch err := err.(type) {
 	case nil:
 		return
+	case *exitError:
+		// The command's exit status is reported via logwrap's own, which
+		// makes this message informative only.
+		fmt.Fprintf(os.Stderr, "%s: %s\n", app, err)
 	case *templateError:
 		pre := fmt.Sprintf("%s: %s:%d", app, err.name, err.pos)
 		fmt.Fprintf(os.Stderr, "%s %s\n", pre, err.text)
@@ -38,7 +47,7 @@ func main() {
 	default:
 		fmt.Fprintf(os.Stderr, "%s: %s\n", app, err)
 	}
-	os.Exit(1)
+	os.Exit(exitCode(err))
 }
 
 func invoke(stdin io.Reader, stdout, stderr io.Writer, args []string) error {
@@ -50,22 +59,54 @@ func invoke(stdin io.Reader, stdout, stderr io.Writer, args []string) error {
 	if err_ := inv.cleanup(); err == nil {
 		err = err_
 	}
-	if _, ok := err.(*exec.ExitError); ok {
-		err = fmt.Errorf("%s: %s", inv.bin, err)
+	if isExitError(err) {
+		err = &exitError{bin: inv.bin, err: err}
 	}
 	return err
 }
 
 func newInvocation(stdin io.Reader, stdout, stderr io.Writer, args []string) (*invocation, error) {
 	var flags struct {
-		name      string
-		maxSize   sizeFlag
-		maxCount  uint
-		file      string
+		name     string
+		maxSize  sizeFlag
+		maxCount uint
+		every    intervalFlag
+		compress compressFlag
+		suffix   suffixFlag
+		maxAge   durationFlag
+		maxTotal sizeFlag
+		format   formatFlag
+		file     string
+		files    struct {
+			stdout, stderr struct {
+				path     string
+				maxSize  sizeFlag
+				maxCount uint
+			}
+		}
 		templates struct {
-			stdout, stderr string
+			stdout, stderr        string
+			start, finish, rotate string
 		}
-		ansi ansiFlag
+		ansi    ansiFlag
+		pty     bool
+		timeout durationFlag
+		drain   durationFlag
+		signals struct {
+			forward         signalsFlag
+			grace           durationFlag
+			interruptWindow durationFlag
+			group           bool
+		}
+		restart struct {
+			mode   restartFlag
+			max    uint
+			delay  durationFlag
+			window durationFlag
+		}
+		multi      bool
+		killOthers bool
+		levels     levelsFlag
 	}
 	fs := flag.NewFlagSet(app, flag.ContinueOnError)
 	fs.Usage = nil
@@ -74,20 +115,57 @@ func newInvocation(stdin io.Reader, stdout, stderr io.Writer, args []string) (*i
 	fs.StringVar(&flags.templates.stdout, "1", defaultStdoutTemplate, "")
 	fs.StringVar(&flags.templates.stderr, "stderr", defaultStderrTemplate, "")
 	fs.StringVar(&flags.templates.stderr, "2", defaultStderrTemplate, "")
+	fs.StringVar(&flags.templates.start, "start-template", defaultStartTemplate, "")
+	fs.StringVar(&flags.templates.finish, "finish-template", defaultFinishTemplate, "")
+	fs.StringVar(&flags.templates.rotate, "rotate-template", defaultRotateTemplate, "")
 	fs.StringVar(&flags.file, "file", "", "")
 	fs.StringVar(&flags.file, "f", "", "")
+	fs.StringVar(&flags.files.stdout.path, "stdout-file", "", "")
+	fs.Var(&flags.files.stdout.maxSize, "stdout-max-size", "")
+	fs.UintVar(&flags.files.stdout.maxCount, "stdout-max-count", 0, "")
+	fs.StringVar(&flags.files.stderr.path, "stderr-file", "", "")
+	fs.Var(&flags.files.stderr.maxSize, "stderr-max-size", "")
+	fs.UintVar(&flags.files.stderr.maxCount, "stderr-max-count", 0, "")
 	fs.StringVar(&flags.name, "name", "", "")
 	fs.StringVar(&flags.name, "n", "", "")
 	fs.UintVar(&flags.maxCount, "max-count", 0, "")
 	fs.UintVar(&flags.maxCount, "c", 0, "")
 	fs.Var(&flags.maxSize, "max-size", "")
 	fs.Var(&flags.maxSize, "s", "")
+	fs.Var(&flags.every, "rotate-every", "")
+	fs.Var(&flags.every, "r", "")
+	fs.Var(&flags.compress, "compress", "")
+	fs.Var(&flags.compress, "z", "")
+	fs.Var(&flags.suffix, "suffix-format", "")
+	fs.Var(&flags.maxAge, "max-age", "")
+	fs.Var(&flags.maxTotal, "max-total", "")
+	fs.Var(&flags.format, "file-format", "")
+	flags.format = formatText
+	fs.Var(&flags.levels, "level", "")
 	fs.Var(&flags.ansi, "ansi", "")
 	fs.Var(&flags.ansi, "a", "")
 	flags.ansi.stdout = true
 	flags.ansi.stderr = true
 
+	fs.Var(&flags.timeout, "timeout", "")
+	fs.Var(&flags.drain, "drain-timeout", "")
+	fs.Var(&flags.signals.forward, "forward", "")
+	fs.Var(&flags.signals.grace, "grace", "")
+	fs.Var(&flags.signals.interruptWindow, "interrupt-window", "")
+	fs.BoolVar(&flags.signals.group, "group", false, "")
+	flags.signals.grace = durationFlag(3 * time.Second)
+	flags.signals.interruptWindow = durationFlag(2 * time.Second)
+	fs.Var(&flags.restart.mode, "restart", "")
+	fs.UintVar(&flags.restart.max, "max-restarts", 0, "")
+	fs.Var(&flags.restart.delay, "restart-delay", "")
+	fs.Var(&flags.restart.window, "restart-window", "")
+	flags.restart.delay = durationFlag(time.Second)
+	flags.restart.window = durationFlag(time.Minute)
+	fs.BoolVar(&flags.multi, "multi", false, "")
+	fs.BoolVar(&flags.killOthers, "kill-others", false, "")
+
 	var quiet, help, ver bool
+	fs.BoolVar(&flags.pty, "pty", false, "")
 	fs.BoolVar(&quiet, "quiet", false, "")
 	fs.BoolVar(&quiet, "q", false, "")
 	fs.BoolVar(&help, "help", false, "")
@@ -102,11 +180,44 @@ func newInvocation(stdin io.Reader, stdout, stderr io.Writer, args []string) (*i
 		return nil, err
 	}
 
+	if flags.pty && !ptySupported {
+		return nil, errors.New("--pty is only supported on Linux")
+	}
+	if flags.signals.group && !processGroupsSupported {
+		return nil, errors.New("--group is not supported on this platform")
+	}
+	if flags.signals.group {
+		// Whatever the command leaves behind in its process group is killed
+		// once the drain timeout passes, so don't wait for it forever.
+		drainSet := false
+		fs.Visit(func(f *flag.Flag) { drainSet = drainSet || f.Name == "drain-timeout" })
+		if !drainSet {
+			flags.drain = durationFlag(defaultGroupDrainTimeout)
+		}
+	}
+
 	inv := &invocation{
+		pty:          flags.pty,
+		timeout:      time.Duration(flags.timeout),
+		drainTimeout: time.Duration(flags.drain),
+		signals: signalPolicy{
+			forward:         flags.signals.forward,
+			grace:           time.Duration(flags.signals.grace),
+			interruptWindow: time.Duration(flags.signals.interruptWindow),
+			group:           flags.signals.group,
+		},
+		restart: restartPolicy{
+			mode:   string(flags.restart.mode),
+			max:    int(flags.restart.max),
+			delay:  time.Duration(flags.restart.delay),
+			window: time.Duration(flags.restart.window),
+		},
+		killOthers:   flags.killOthers,
 		args:         fs.Args(),
 		stdin:        stdin,
 		stdout:       stdout,
 		stderr:       stderr,
+		outputLock:   new(sync.Mutex),
 		placeholders: defaultPlaceholders(),
 		cleanup:      func() error { return nil },
 	}
@@ -114,7 +225,7 @@ func newInvocation(stdin io.Reader, stdout, stderr io.Writer, args []string) (*i
 	if quiet {
 		inv.stdout = ioutil.Discard
 		inv.stderr = ioutil.Discard
-		if flags.file == "" {
+		if flags.file == "" && flags.files.stdout.path == "" && flags.files.stderr.path == "" {
 			// Abort if we're quiet and no logfile is specified, otherwise we'd
 			// just run the command and discard its output.
 			return nil, errors.New("nothing to do: too quiet")
@@ -124,28 +235,42 @@ func newInvocation(stdin io.Reader, stdout, stderr io.Writer, args []string) (*i
 	var (
 		reading = inv.stdin != nil && len(inv.args) == 0
 		helping = help || len(inv.args) == 0
-		hooks   []func() error
+		hooks   []func(*invocation) error
+		specs   []sessionSpec
 	)
 
-	setBin := func() error {
+	// Sessions are named after their commands, unless named explicitly.
+	setSpecs := func(inv *invocation) (err error) {
+		specs, err = parseSessionSpecs(inv.args)
+		return err
+	}
+
+	setBin := func(inv *invocation) error {
 		inv.bin = inv.args[0]
 		inv.args = inv.args[1:]
 		return nil
 	}
 
-	setName := func() error {
+	setName := func(inv *invocation) error {
 		inv.name = flags.name
 		switch {
 		case inv.name == "" && reading:
 			inv.name = "stdin"
+		case inv.name == "" && len(specs) > 0:
+			names := make([]string, len(specs))
+			for i, spec := range specs {
+				names[i] = spec.name
+			}
+			inv.name = strings.Join(names, ",")
 		case inv.name == "":
 			inv.name = filepath.Base(inv.bin)
 		}
 		inv.constant("name", inv.name)
+		inv.constant("color", sessionColors[0])
 		return nil
 	}
 
-	setPath := func() error {
+	setPath := func(inv *invocation) error {
 		inv.set("path", placeholderFunc(func(args []string) (string, error) {
 			if len(args) == 0 {
 				return inv.bin, nil
@@ -168,60 +293,197 @@ func newInvocation(stdin io.Reader, stdout, stderr io.Writer, args []string) (*i
 		return nil
 	}
 
-	setLog := func() error {
-		if flags.file == "" {
-			return nil
+	setStats := func(inv *invocation) error {
+		inv.started = time.Now()
+		inv.set("pid", placeholderFunc(func([]string) (string, error) {
+			if pid := atomic.LoadInt64(&inv.pid); pid != 0 {
+				return strconv.FormatInt(pid, 10), nil
+			}
+			return "", errNoValue
+		}))
+		inv.set("exit", placeholderFunc(func(args []string) (string, error) {
+			if len(args) > 0 {
+				return strconv.Itoa(exitCode(inv.rc)), nil
+			}
+			return exitStatus(inv.rc), nil
+		}))
+		inv.set("elapsed", placeholderFunc(func([]string) (string, error) {
+			return ms(time.Since(inv.started)), nil
+		}))
+		inv.set("bytes", placeholderFunc(func([]string) (string, error) {
+			return humanBytes(inv.bytes), nil
+		}))
+		inv.set("lines", placeholderFunc(func([]string) (string, error) {
+			return strconv.FormatUint(inv.lines, 10), nil
+		}))
+		inv.set("restarts", placeholderFunc(func([]string) (string, error) {
+			return strconv.Itoa(inv.restarts), nil
+		}))
+		return nil
+	}
+
+	setLevels := func(inv *invocation) error {
+		if len(flags.levels) > 0 {
+			level, levelcolor := levelPlaceholders(flags.levels)
+			inv.set("level", level)
+			inv.set("levelcolor", levelcolor)
 		}
-		if flags.maxCount > 0 && flags.maxSize == 0 {
-			return errors.New("unable to determine when to rotate logfiles without a maximum size")
+		return nil
+	}
+
+	setNotices := func(inv *invocation) error {
+		// Notice templates are disabled if set to the empty string.
+		for _, n := range []struct {
+			tmpl   *(*template)
+			name   string
+			text   string
+			def    string
+			notice string
+		}{
+			{&inv.notices.start, "start-template", flags.templates.start, defaultStartTemplate, defaultStartNotice},
+			{&inv.notices.finish, "finish-template", flags.templates.finish, defaultFinishTemplate, defaultFinishNotice},
+			{&inv.notices.rotate, "rotate-template", flags.templates.rotate, defaultRotateTemplate, defaultRotateNotice},
+		} {
+			if n.text == "" {
+				continue
+			}
+			if inv.recorder != nil && n.text == n.def {
+				n.text = n.notice
+			}
+			var err error
+			if *n.tmpl, err = newTemplate(n.name, n.text, inv.placeholders); err != nil {
+				return err
+			}
 		}
-		var (
-			f   io.WriteCloser
-			err error
-		)
-		if flags.maxSize > 0 {
-			f, err = newFileRotator(
-				flags.file,
-				int64(flags.maxSize),
-				int(flags.maxCount),
-			)
-		} else {
-			f, err = openLogfile(flags.file)
+		return nil
+	}
+
+	setLog := func(inv *invocation) error {
+		// Structured logfiles record the original lines rather than the
+		// rendered templates.
+		if flags.format != formatText {
+			inv.recorder = &recorder{
+				format: string(flags.format),
+				name:   inv.name,
+			}
 		}
-		if err != nil {
+
+		if err := setNotices(inv); err != nil {
 			return err
 		}
-		inv.log = f
-		if !flags.ansi.file {
-			inv.log = &ansiStripper{inv.log}
+
+		opts := rotateOpts{
+			maxSize:  int64(flags.maxSize),
+			maxCount: int(flags.maxCount),
+			every:    flags.every.rotateInterval,
+			compress: string(flags.compress),
+			suffix:   string(flags.suffix),
+			maxAge:   time.Duration(flags.maxAge),
+			maxTotal: int64(flags.maxTotal),
 		}
 
-		// Write out a notice message when we're done with the log.
-		init := time.Now()
-		inv.log = newCloseWriter(inv.log,
-			func(w io.Writer) error {
-				msg := "finished %s after %s/%s"
-				args := []interface{}{bold(inv.name), ms(time.Since(init)), humanBytes(inv.bytes)}
-				if inv.rc != nil {
-					msg += ": %s"
-					args = append(args, inv.rc)
+		openLog := func(name, text string, opts rotateOpts) (io.WriteCloser, error) {
+			rotating := opts.maxSize > 0 || !opts.every.isZero()
+			if opts.retaining() && !rotating {
+				return nil, errors.New("unable to determine when to rotate logfiles without a maximum size or interval")
+			}
+
+			// Logfile paths are templates, rendered when opened and again on
+			// each rotation.
+			tmpl, err := newTemplate(name, text, inv.placeholders)
+			if err != nil {
+				return nil, err
+			}
+			render := func() (string, error) { return tmpl.renderPath() }
+			path, err := render()
+			if err != nil {
+				return nil, fmt.Errorf("--%s: cannot render %q: %s", name, text, err)
+			}
+
+			var f interface {
+				io.WriteCloser
+				reopener
+			}
+			if rotating {
+				var r *fileRotator
+				if r, err = newFileRotator(path, opts); err == nil {
+					r.render = render
+					r.onRotate = func(w io.Writer) error {
+						if inv.recorder == nil && !flags.ansi.file {
+							w = &ansiStripper{w}
+						}
+						return renderNotice(inv.noticeWriter(w), inv.notices.rotate)
+					}
+					f = r
 				}
-				return notice(w, msg, args...)
-			},
-		)
-		inv.ensureLast(inv.log.Close)
+			} else {
+				f, err = openLogfile(path)
+			}
+			if err != nil {
+				return nil, err
+			}
+			inv.logfiles = append(inv.logfiles, f)
+			var log io.WriteCloser = f
+			if inv.recorder == nil && !flags.ansi.file {
+				log = &ansiStripper{log}
+			}
+
+			// Write out a notice message when we're done with the log.
+			log = newCloseWriter(log,
+				func(w io.Writer) error {
+					return renderNotice(inv.noticeWriter(w), inv.notices.finish)
+				},
+			)
+			inv.ensureLast(log.Close)
 
-		// Also write a notice message when initialized.
-		return notice(inv.log, "started %s", bold(inv.name))
+			// Also write a notice message when initialized.
+			return log, renderNotice(inv.noticeWriter(log), inv.notices.start)
+		}
+
+		// Stream-specific logfiles share the rotation options of the main
+		// logfile, unless overridden.
+		for _, l := range []struct {
+			log      *io.WriteCloser
+			name     string
+			path     string
+			maxSize  sizeFlag
+			maxCount uint
+		}{
+			{&inv.log, "file", flags.file, 0, 0},
+			{&inv.streamLogs.stdout, "stdout-file", flags.files.stdout.path, flags.files.stdout.maxSize, flags.files.stdout.maxCount},
+			{&inv.streamLogs.stderr, "stderr-file", flags.files.stderr.path, flags.files.stderr.maxSize, flags.files.stderr.maxCount},
+		} {
+			if l.path == "" {
+				continue
+			}
+			opts := opts
+			if l.maxSize > 0 {
+				opts.maxSize = int64(l.maxSize)
+			}
+			if l.maxCount > 0 {
+				opts.maxCount = int(l.maxCount)
+			}
+			var err error
+			if *l.log, err = openLog(l.name, l.path, opts); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
-	setOutputs := func() error {
+	setOutputs := func(inv *invocation) error {
 		var (
 			stdout = flags.templates.stdout
 			stderr = flags.templates.stderr
 		)
-		// Abort if the user specifically set both templates to the empty string.
-		if stdout == "" && stderr == "" {
+		if flags.multi && stdout == defaultStdoutTemplate {
+			stdout = defaultMultiStdoutTemplate
+		}
+		// Abort if the user specifically set both templates to the empty
+		// string, unless there's a structured logfile to write records to.
+		structuredLog := inv.recorder != nil &&
+			(inv.log != nil || inv.streamLogs.stdout != nil || inv.streamLogs.stderr != nil)
+		if stdout == "" && stderr == "" && !structuredLog {
 			return errors.New("nothing to do: no templates defined")
 		}
 
@@ -230,63 +492,116 @@ func newInvocation(stdin io.Reader, stdout, stderr io.Writer, args []string) (*i
 			name     string
 			template string
 			ansi     bool
+			log      io.Writer
 		}{
-			{&inv.stdout, "stdout", stdout, flags.ansi.stdout},
-			{&inv.stderr, "stderr", stderr, flags.ansi.stderr},
+			{&inv.stdout, "stdout", stdout, flags.ansi.stdout, inv.streamLogs.stdout},
+			{&inv.stderr, "stderr", stderr, flags.ansi.stderr, inv.streamLogs.stderr},
 		} {
-			// Discard output if no template set.
-			if c.template == "" {
-				*c.stream = ioutil.Discard
-				continue
+			var logs []io.Writer
+			if inv.log != nil {
+				logs = append(logs, inv.log)
 			}
-
-			tmpl, err := newTemplate(c.name, c.template, inv.placeholders)
-			if err != nil {
-				return err
+			if c.log != nil {
+				logs = append(logs, c.log)
 			}
-			output := *c.stream
-			if !c.ansi {
-				output = &ansiStripper{output}
+
+			// Text logfiles receive the rendered template, while structured
+			// ones receive records of the original lines, regardless of the
+			// template.
+			structured := len(logs) > 0 && inv.recorder != nil
+
+			var ws []io.Writer
+			if c.template != "" {
+				tmpl, err := newTemplate(c.name, c.template, inv.placeholders)
+				if err != nil {
+					return err
+				}
+				output := *c.stream
+				if !c.ansi {
+					output = &ansiStripper{output}
+				}
+				if len(logs) > 0 && !structured {
+					output = io.MultiWriter(append([]io.Writer{output}, logs...)...)
+				}
+				ws = append(ws, &templateWriter{template: tmpl, Writer: output})
 			}
-			if inv.log != nil {
-				output = io.MultiWriter(output, inv.log)
+			if structured {
+				ws = append(ws, &recordWriter{
+					Writer:   io.MultiWriter(logs...),
+					recorder: inv.recorder,
+					stream:   c.name,
+				})
 			}
-			lw := &linewiseWriter{
-				Writer: &templateWriter{
-					template: tmpl,
-					Writer:   output,
-				},
+			// Discard output if there's nowhere to write it to.
+			if len(ws) == 0 {
+				*c.stream = ioutil.Discard
+				continue
 			}
+			lw := &linewiseWriter{Writer: io.MultiWriter(ws...)}
 			inv.ensureFirst(lw.Close)
 			*c.stream = lw
 		}
 		return nil
 	}
 
+	// Sessions share the logfiles of inv, which are closed only after all
+	// of them are done with them.
+	setSessions := func(inv *invocation) error {
+		for i, spec := range specs {
+			s := inv.newSession(spec.name, spec.args)
+			s.constant("color", sessionColors[i%len(sessionColors)])
+			for _, fn := range []func(*invocation) error{setPath, setStats, setLevels, setNotices, setOutputs} {
+				if err := fn(s); err != nil {
+					return err
+				}
+			}
+			inv.ensureFirst(func() error { return s.cleanup() })
+			inv.sessions = append(inv.sessions, s)
+		}
+		return nil
+	}
+
 	switch {
 	case ver:
 		inv.invoke = inv.doVersion
 	case reading:
-		hooks = []func() error{
+		hooks = []func(*invocation) error{
 			setName,
+			setStats,
+			setLevels,
 			setLog,
 			setOutputs,
 		}
 		inv.invoke = inv.doRead
 	case helping:
 		inv.invoke = inv.doHelp
+	case flags.multi:
+		hooks = []func(*invocation) error{
+			setSpecs,
+			setName,
+			setStats,
+			setLevels,
+			setLog,
+			setSessions,
+		}
+		inv.invoke = inv.doMulti
 	default:
-		hooks = []func() error{
+		hooks = []func(*invocation) error{
 			setBin,
 			setName,
 			setPath,
+			setStats,
+			setLevels,
 			setLog,
 			setOutputs,
 		}
 		inv.invoke = inv.doRun
+		if inv.restart.mode != "" {
+			inv.invoke = inv.doSupervise
+		}
 	}
 	for _, fn := range hooks {
-		if err := fn(); err != nil {
+		if err := fn(inv); err != nil {
 			return nil, err
 		}
 	}
@@ -318,11 +633,64 @@ func parseEnv(fs *flag.FlagSet) error {
 	return nil
 }
 
+// sessionSpec describes a command run by --multi, given as "name=command",
+// or just "command", in which case the session is named after the command.
+type sessionSpec struct {
+	name string
+	args []string
+}
+
+func parseSessionSpecs(args []string) ([]sessionSpec, error) {
+	specs := make([]sessionSpec, 0, len(args))
+	for _, arg := range args {
+		var spec sessionSpec
+		cmd := arg
+		if i := strings.IndexByte(arg, '='); i > 0 && !strings.ContainsAny(arg[:i], " \t'\"/") {
+			spec.name, cmd = arg[:i], arg[i+1:]
+		}
+		var err error
+		if spec.args, err = shellwords.Split(cmd); err != nil {
+			return nil, fmt.Errorf("%q: unbalanced quotes", arg)
+		}
+		if len(spec.args) == 0 {
+			return nil, fmt.Errorf("%q: no command given", arg)
+		}
+		if spec.name == "" {
+			spec.name = filepath.Base(spec.args[0])
+		}
+		specs = append(specs, spec)
+	}
+	return specs, nil
+}
+
+// sessionColors are assigned to sessions in order, and used by the default
+// --stdout template under --multi, as well as by "auto" colors on terminals
+// limited to 16 colors. Red is left out, since it marks standard error.
+var sessionColors = []string{
+	"green",
+	"yellow",
+	"blue",
+	"magenta",
+	"cyan",
+	"light-green",
+	"light-yellow",
+	"light-blue",
+	"light-magenta",
+	"light-cyan",
+}
+
 type invocation struct {
+	pid int64 // accessed atomically; keep 64-bit aligned
+
 	name           string
 	bin            string
 	args           []string
 	log            io.WriteCloser
+	streamLogs     struct{ stdout, stderr io.WriteCloser }
+	notices        struct{ start, finish, rotate *template }
+	logfiles       []reopener
+	pty            bool      // run the command on a pseudo-terminal
+	recorder       *recorder // set for structured logfiles
 	stdin          io.Reader
 	stdout, stderr io.Writer
 	placeholders
@@ -331,8 +699,149 @@ type invocation struct {
 	invoke  func() error
 	cleanup func() error
 
+	timeout      time.Duration
+	drainTimeout time.Duration // time to wait for output once the command exits
+	signals      signalPolicy
+	restart      restartPolicy
+	restarts     int            // number of times the command was restarted
+	started      time.Time      // when the command was last (re)started
+	interrupted  int32          // set if a terminating signal was forwarded to the command
+	sigch        chan os.Signal // set while supervised, so as to span restarts
+
+	sessions   []*invocation // commands run concurrently by doMulti
+	killOthers bool          // terminate all sessions once one of them exits
+	quit       chan struct{} // closed to terminate the command of a session
+	outputLock *sync.Mutex   // shared by all sessions writing to the same outputs
+
 	rc    error  // non-nil if doRun/doRead fails
 	bytes uint64 // pure byte count for stdin or stdout+stderr
+	lines uint64 // line count for the same
+}
+
+// reopener is implemented by logfiles that can be reopened on request.
+type reopener interface {
+	requestReopen()
+}
+
+func (inv *invocation) reopenLogs() {
+	for _, f := range inv.logfiles {
+		f.requestReopen()
+	}
+}
+
+// handleHUP reopens the logfiles if sig is SIGHUP, which is how tools like
+// logrotate signal that they've moved them, and reports whether it was.
+func (inv *invocation) handleHUP(sig os.Signal) (handled bool) {
+	if sig != syscall.SIGHUP {
+		return false
+	}
+	if len(inv.logfiles) > 0 {
+		inv.reopenLogs()
+		notice(os.Stderr, "received SIGHUP; reopening logfiles")
+	}
+	return true
+}
+
+// signalNames are the names of the signals logwrap handles on behalf of the
+// command, as printed in notices.
+var signalNames = map[os.Signal]string{
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGKILL: "SIGKILL",
+}
+
+// defaultGroupDrainTimeout bounds the time spent draining output under
+// --group, unless --drain-timeout is set.
+const defaultGroupDrainTimeout = time.Second
+
+// signalPolicy controls how signals received by logwrap are relayed to the
+// command.
+type signalPolicy struct {
+	forward         []os.Signal   // signals forwarded as-is
+	grace           time.Duration // time to exit after SIGTERM/SIGQUIT before SIGKILL
+	interruptWindow time.Duration // time within which a second SIGINT escalates to SIGTERM
+	group           bool          // signal the whole process group of the command
+}
+
+// forwards reports whether sig is forwarded to the command as-is.
+func (p signalPolicy) forwards(sig os.Signal) bool {
+	for _, s := range p.forward {
+		if s == sig {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	restartOnFailure = "on-failure"
+	restartAlways    = "always"
+
+	maxRestartDelay = time.Minute
+)
+
+// restartPolicy controls whether and when the command is restarted once it
+// exits.
+type restartPolicy struct {
+	mode   string // restartOnFailure or restartAlways
+	max    int    // maximum number of consecutive restarts, if non-zero
+	delay  time.Duration
+	window time.Duration // run time after which the command is deemed stable
+}
+
+// noticeWriter wraps w such that notices are records of their own in
+// structured logfiles.
+func (inv *invocation) noticeWriter(w io.Writer) io.Writer {
+	if inv.recorder != nil {
+		return &recordWriter{Writer: w, recorder: inv.recorder, stream: app}
+	}
+	return w
+}
+
+// noticeLogs renders the notice template t to all logfiles, which may be
+// shared with other sessions.
+func (inv *invocation) noticeLogs(t *template) {
+	inv.outputLock.Lock()
+	defer inv.outputLock.Unlock()
+	for _, log := range []io.Writer{inv.log, inv.streamLogs.stdout, inv.streamLogs.stderr} {
+		if log != nil {
+			renderNotice(inv.noticeWriter(log), t)
+		}
+	}
+}
+
+// newSession creates an invocation of the command args, named name, that
+// shares the outputs, logfiles and policies of inv.
+func (inv *invocation) newSession(name string, args []string) *invocation {
+	s := &invocation{
+		name:         name,
+		bin:          args[0],
+		args:         args[1:],
+		log:          inv.log,
+		streamLogs:   inv.streamLogs,
+		logfiles:     inv.logfiles,
+		pty:          inv.pty,
+		stdout:       inv.stdout,
+		stderr:       inv.stderr,
+		placeholders: defaultPlaceholders(),
+		cleanup:      func() error { return nil },
+		timeout:      inv.timeout,
+		drainTimeout: inv.drainTimeout,
+		signals:      inv.signals,
+		restart:      inv.restart,
+		quit:         make(chan struct{}),
+		outputLock:   inv.outputLock,
+	}
+	if inv.recorder != nil {
+		s.recorder = &recorder{format: inv.recorder.format, name: name}
+	}
+	s.constant("name", name)
+	s.invoke = s.doRun
+	if s.restart.mode != "" {
+		s.invoke = s.doSupervise
+	}
+	return s
 }
 
 func (inv *invocation) ensureFirst(fn func() error) { inv.ensure(true, fn) }
@@ -360,45 +869,125 @@ func (inv *invocation) doRun() (err error) {
 
 	cmd := exec.Command(inv.bin, inv.args...)
 	cmd.Stdin = inv.stdin
-	cmd.Stdout, cmd.Stderr = newInterlockedWriterPair(
-		&byteCounter{Writer: inv.stdout, n: &inv.bytes},
-		&byteCounter{Writer: inv.stderr, n: &inv.bytes},
+	cmd.Stdout, cmd.Stderr = newInterlockedWriterPair(inv.outputLock,
+		&byteCounter{Writer: inv.stdout, n: &inv.bytes, lines: &inv.lines},
+		&byteCounter{Writer: inv.stderr, n: &inv.bytes, lines: &inv.lines},
 	)
 
-	if err := cmd.Start(); err != nil {
-		return err
+	if inv.signals.group {
+		setProcessGroup(cmd)
+	}
+
+	// Output streams that are not copied by cmd itself, along with the
+	// goroutines that copy them.
+	var (
+		outputs []io.Closer
+		copying sync.WaitGroup
+	)
+	switch {
+	case inv.pty:
+		// Under a pseudo-terminal, both output streams are merged into the
+		// standard output.
+		stdout := cmd.Stdout
+		pty, stop, err := startPty(cmd)
+		if err != nil {
+			return err
+		}
+		defer stop()
+		if inv.stdin != nil {
+			go func() {
+				io.Copy(pty, inv.stdin)
+				pty.Write([]byte{4}) // ^D, i.e., EOF
+			}()
+		}
+		outputs = append(outputs, pty)
+		copying.Add(1)
+		go func() {
+			// Reading fails with EIO once the terminal is closed on the other end.
+			defer copying.Done()
+			io.Copy(stdout, pty)
+		}()
+	case inv.drainTimeout > 0:
+		// Copy the output streams ourselves, such that waiting for the
+		// command doesn't involve waiting for whoever else holds them open.
+		var ws []io.Closer
+		for _, out := range []*io.Writer{&cmd.Stdout, &cmd.Stderr} {
+			r, w, err := os.Pipe()
+			if err != nil {
+				return err
+			}
+			dst := *out
+			*out = w
+			ws = append(ws, w)
+			outputs = append(outputs, r)
+			copying.Add(1)
+			go func() {
+				defer copying.Done()
+				io.Copy(dst, r)
+			}()
+		}
+		err := cmd.Start()
+		closeAll(ws)
+		if err != nil {
+			copying.Wait()
+			closeAll(outputs)
+			return err
+		}
+	default:
+		if err := cmd.Start(); err != nil {
+			return err
+		}
+	}
+	atomic.StoreInt64(&inv.pid, int64(cmd.Process.Pid))
+	if inv.recorder != nil {
+		inv.recorder.setPid(cmd.Process.Pid)
 	}
-	inv.constant("pid", strconv.Itoa(cmd.Process.Pid))
 
 	// Capture SIGINT, SIGQUIT and SIGTERM and try to exit gracefully.
-	wait := make(chan struct{})
-	sigch := make(chan os.Signal, 1)
-	signal.Notify(sigch,
-		syscall.SIGINT,
-		syscall.SIGQUIT,
-		syscall.SIGTERM,
-		// syscall.SIGCHLD, // not available on Windows
+	wait, handled := make(chan struct{}), make(chan struct{})
+	sigch := inv.sigch
+	if sigch == nil {
+		var stop func()
+		sigch, stop = inv.notifySignals()
+		defer stop()
+	}
+	atomic.StoreInt32(&inv.interrupted, 0)
+
+	// Terminate the command once it runs out of time, the same way as if
+	// it were sent SIGTERM.
+	var (
+		deadline <-chan time.Time
+		timedOut int32
 	)
+	if inv.timeout > 0 {
+		t := time.NewTimer(inv.timeout)
+		defer t.Stop()
+		deadline = t.C
+	}
+	quit := inv.quit
 	go func() {
-		signam := map[os.Signal]string{
-			syscall.SIGINT:  "SIGINT",
-			syscall.SIGQUIT: "SIGQUIT",
-			syscall.SIGTERM: "SIGTERM",
-			syscall.SIGKILL: "SIGKILL",
-		}
-		const (
-			interruptWindow = 2 * time.Second
-			killDelay       = 3 * time.Second
-		)
+		defer close(handled)
 		var (
-			lastSig   os.Signal
-			lastSigAt time.Time
-			killing   bool
-			kill      = time.NewTimer(math.MaxInt64) // we don't want this to fire prematurely
+			interruptWindow = inv.signals.interruptWindow
+			killDelay       = inv.signals.grace
+			lastSig         os.Signal
+			lastSigAt       time.Time
+			killing         bool
+			kill            = time.NewTimer(math.MaxInt64) // we don't want this to fire prematurely
 		)
+		send := func(sig os.Signal) {
+			if inv.signals.group {
+				signalGroup(cmd.Process, sig)
+			} else {
+				cmd.Process.Signal(sig)
+			}
+		}
 		notify := func(sig os.Signal) {
 			msgf := "sent %s to %s (pid %d)"
-			args := []interface{}{signam[sig], inv.bin, cmd.Process.Pid}
+			args := []interface{}{signalNames[sig], inv.bin, cmd.Process.Pid}
+			if inv.signals.group {
+				msgf = "sent %s to %s (process group %d)"
+			}
 			switch sig {
 			case syscall.SIGINT:
 				msgf += "; send again within %s to terminate..."
@@ -415,22 +1004,46 @@ func (inv *invocation) doRun() (err error) {
 		for {
 			select {
 			case <-kill.C:
-				cmd.Process.Signal(syscall.SIGKILL)
+				send(syscall.SIGKILL)
 				notify(syscall.SIGKILL)
+			case <-quit:
+				// Terminated on behalf of another session.
+				quit = nil
+				atomic.StoreInt32(&inv.interrupted, 1)
+				if !killing {
+					send(syscall.SIGTERM)
+					notify(syscall.SIGTERM)
+				}
+			case <-deadline:
+				atomic.StoreInt32(&timedOut, 1)
+				if !killing {
+					notice(os.Stderr, "%s timed out after %s", inv.bin, inv.timeout)
+					send(syscall.SIGTERM)
+					notify(syscall.SIGTERM)
+				}
 			case sig := <-sigch:
+				hup := inv.handleHUP(sig)
+				if inv.signals.forwards(sig) {
+					send(sig)
+					continue
+				}
+				if hup {
+					continue
+				}
+				atomic.StoreInt32(&inv.interrupted, 1)
 				switch {
 				case killing:
 					// Ignore any signal until the subprocess is killed.
 				case sig == syscall.SIGINT && lastSig == syscall.SIGINT && time.Since(lastSigAt) <= interruptWindow:
 					// Attempt to terminate the subprocess if multiple
 					// interrupts are received within a time window.
-					cmd.Process.Signal(syscall.SIGTERM)
+					send(syscall.SIGTERM)
 					notify(syscall.SIGTERM)
 				case sig == syscall.SIGINT:
-					cmd.Process.Signal(syscall.SIGINT)
+					send(syscall.SIGINT)
 					notify(sig)
 				case sig == syscall.SIGQUIT, sig == syscall.SIGTERM:
-					cmd.Process.Signal(sig)
+					send(sig)
 					notify(sig)
 				default:
 					panic(fmt.Sprintf("unhandled signal: %s", sig))
@@ -444,13 +1057,206 @@ func (inv *invocation) doRun() (err error) {
 
 	err = cmd.Wait()
 	close(wait) // kill the signal handler goroutine
+	<-handled
+	inv.drain(cmd.Process, &copying, outputs)
+	if atomic.LoadInt32(&timedOut) == 1 {
+		err = &timeoutError{after: inv.timeout, err: err}
+	}
 	return
 }
 
+// notifySignals relays the signals handled on behalf of the command to sigch
+// until stop is called.
+func (inv *invocation) notifySignals() (sigch chan os.Signal, stop func()) {
+	sigch = make(chan os.Signal, 1)
+	sigs := []os.Signal{
+		syscall.SIGINT,
+		syscall.SIGQUIT,
+		syscall.SIGTERM,
+		// syscall.SIGCHLD, // not available on Windows
+	}
+	sigs = append(sigs, inv.signals.forward...)
+	if len(inv.logfiles) > 0 {
+		// See handleHUP.
+		sigs = append(sigs, syscall.SIGHUP)
+	}
+	signal.Notify(sigch, sigs...)
+	return sigch, func() { signal.Stop(sigch) }
+}
+
+// drain waits for the output of the command to be copied, for no longer than
+// the drain timeout, if set. Past that, the output streams are closed, and
+// the processes that still hold them open are killed if they belong to the
+// process group of the command.
+func (inv *invocation) drain(p *os.Process, copying *sync.WaitGroup, outputs []io.Closer) {
+	done := make(chan struct{})
+	go func() {
+		copying.Wait()
+		close(done)
+	}()
+	var timeout <-chan time.Time
+	if inv.drainTimeout > 0 {
+		t := time.NewTimer(inv.drainTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case <-done:
+	case <-timeout:
+		notice(os.Stderr, "output of %s still open %s after it exited; closing it", inv.bin, inv.drainTimeout)
+		if inv.signals.group {
+			signalGroup(p, syscall.SIGKILL)
+		}
+		closeAll(outputs)
+		<-done
+	}
+}
+
+// doSupervise runs the command, restarting it according to the restart
+// policy. The delay between restarts doubles each time, and is reset along
+// with the restart count once the command manages to run for longer than the
+// restart window.
+func (inv *invocation) doSupervise() error {
+	var (
+		delay    = inv.restart.delay
+		attempts int
+	)
+
+	// Signals are captured once for all runs, such that none go unhandled
+	// in between.
+	sigch, stop := inv.notifySignals()
+	defer stop()
+	inv.sigch = sigch
+
+	for {
+		err := inv.doRun()
+		switch {
+		case atomic.LoadInt32(&inv.interrupted) == 1:
+			// Terminated on the user's behalf.
+			return err
+		case err != nil && !isExitError(err):
+			// Failed to start.
+			return err
+		case err == nil && inv.restart.mode == restartOnFailure:
+			return nil
+		}
+
+		if time.Since(inv.started) >= inv.restart.window {
+			delay, attempts = inv.restart.delay, 0
+		}
+		if inv.restart.max > 0 && attempts >= inv.restart.max {
+			// The logfiles receive the finish notice once closed.
+			notice(os.Stderr, "%s %s; giving up after %d restarts", bold(inv.name), exitStatus(err), attempts)
+			return err
+		}
+		notice(os.Stderr, "%s %s; restarting in %s", bold(inv.name), exitStatus(err), delay)
+		inv.noticeLogs(inv.notices.finish)
+
+		// Stop supervising if interrupted while waiting.
+		wait := time.NewTimer(delay)
+	WAIT:
+		for {
+			select {
+			case <-wait.C:
+				break WAIT
+			case sig := <-sigch:
+				if inv.handleHUP(sig) || inv.signals.forwards(sig) {
+					// There's no command to forward signals to.
+					continue
+				}
+				wait.Stop()
+				notice(os.Stderr, "received %s; not restarting %s", signalNames[sig], bold(inv.name))
+				return err
+			case <-inv.quit:
+				wait.Stop()
+				return err
+			}
+		}
+
+		attempts++
+		inv.restarts++
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+		// Each run is timed on its own, such that {elapsed} doesn't span
+		// restarts.
+		inv.started = time.Now()
+		inv.noticeLogs(inv.notices.start)
+	}
+}
+
+// doMulti runs the commands of all sessions concurrently, and returns the
+// error of the first one to fail. With killOthers set, the remaining sessions
+// are terminated once the first one exits, whose error is returned instead.
+func (inv *invocation) doMulti() error {
+	type result struct {
+		s   *invocation
+		err error
+	}
+	results := make(chan result, len(inv.sessions))
+	for _, s := range inv.sessions {
+		// Each session's block in the logfiles starts with a notice of its
+		// own, much like it ends with one.
+		s.noticeLogs(s.notices.start)
+		go func(s *invocation) {
+			results <- result{s, s.invoke()}
+		}(s)
+	}
+
+	var err error
+	for i := range inv.sessions {
+		r := <-results
+		msg := fmt.Sprintf("%s %s", bold(r.s.name), exitStatus(r.err))
+		if isExitError(r.err) {
+			r.err = &exitError{bin: r.s.name, err: r.err}
+		}
+		switch {
+		case i == 0 && inv.killOthers:
+			err = r.err
+			if len(inv.sessions) > 1 {
+				msg += "; stopping the others"
+			}
+			for _, s := range inv.sessions {
+				if s != r.s {
+					close(s.quit)
+				}
+			}
+		case err == nil && !inv.killOthers:
+			err = r.err
+		}
+		notice(os.Stderr, "%s", msg)
+		r.s.noticeLogs(r.s.notices.finish)
+		inv.bytes += r.s.bytes
+		inv.lines += r.s.lines
+	}
+	inv.rc = err
+	return err
+}
+
 func (inv *invocation) doRead() error {
-	n, err := io.Copy(inv.stdout, inv.stdin)
+	// Reopen logfiles on SIGHUP while reading.
+	if len(inv.logfiles) > 0 {
+		sigch := make(chan os.Signal, 1)
+		signal.Notify(sigch, syscall.SIGHUP)
+		done := make(chan struct{})
+		defer func() {
+			signal.Stop(sigch)
+			close(done)
+		}()
+		go func() {
+			for {
+				select {
+				case sig := <-sigch:
+					inv.handleHUP(sig)
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	_, err := io.Copy(&byteCounter{Writer: inv.stdout, n: &inv.bytes, lines: &inv.lines}, inv.stdin)
 	inv.rc = err
-	inv.bytes = uint64(n)
 	return err
 }
 
@@ -523,6 +1329,97 @@ func nopNotice(io.Writer, string, ...interface{}) error {
 	return nil
 }
 
+type noticeTemplateFunc func(io.Writer, *template) error
+
+var renderNotice noticeTemplateFunc = writeNotice
+
+// writeNotice renders t as a single line of output, unless t is nil, i.e.,
+// the notice is disabled.
+func writeNotice(w io.Writer, t *template) error {
+	if t == nil {
+		return nil
+	}
+	s, err := t.renderString("")
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, s+"\n")
+	return err
+}
+
+// nopRenderNotice replaces renderNotice during tests.
+func nopRenderNotice(io.Writer, *template) error {
+	return nil
+}
+
+// exitError wraps the exit status of the underlying command, such that
+// logwrap can exit with the same code.
+type exitError struct {
+	bin string
+	err error // *exec.ExitError or *timeoutError
+}
+
+func (e *exitError) Error() string {
+	return fmt.Sprintf("%s: %s", e.bin, exitStatus(e.err))
+}
+
+// timeoutError reports that the command was terminated for running longer
+// than allowed.
+type timeoutError struct {
+	after time.Duration
+	err   error // how the command exited afterwards
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s (%s)", e.after, exitStatus(e.err))
+}
+
+// exitStatus describes the exit status that corresponds to err.
+func exitStatus(err error) string {
+	switch err := err.(type) {
+	case nil:
+		return "exited with status 0"
+	case *exec.ExitError:
+		if ws, ok := err.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return fmt.Sprintf("killed by signal %d", ws.Signal())
+		}
+		return fmt.Sprintf("exited with status %d", err.ExitCode())
+	default:
+		return err.Error()
+	}
+}
+
+// isExitError reports whether err describes how the command exited, as
+// opposed to why it failed to run.
+func isExitError(err error) bool {
+	switch err.(type) {
+	case *exec.ExitError, *timeoutError:
+		return true
+	}
+	return false
+}
+
+// exitCode returns the exit code that corresponds to err, which, like in
+// most shells, is 128 plus the signal number if the command was killed by a
+// signal, or 124 if it timed out, like with timeout(1).
+func exitCode(err error) int {
+	switch err := err.(type) {
+	case nil:
+		return 0
+	case *exitError:
+		return exitCode(err.err)
+	case *timeoutError:
+		return 124
+	case *exec.ExitError:
+		if ws, ok := err.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			return 128 + int(ws.Signal())
+		}
+		return err.ExitCode()
+	default:
+		return 1
+	}
+}
+
 type sizeFlag uint64
 
 func (f *sizeFlag) Set(s string) error {
@@ -538,6 +1435,168 @@ func (f *sizeFlag) String() string {
 	return strconv.FormatUint(uint64(*f), 10)
 }
 
+type durationFlag time.Duration
+
+func (f *durationFlag) Set(s string) error {
+	val, err := parseDuration(s)
+	if err != nil {
+		return err
+	}
+	*f = durationFlag(val)
+	return nil
+}
+
+func (f *durationFlag) String() string {
+	return time.Duration(*f).String()
+}
+
+type intervalFlag struct {
+	rotateInterval
+}
+
+func (f *intervalFlag) Set(s string) error {
+	val, err := parseInterval(s)
+	if err != nil {
+		return err
+	}
+	f.rotateInterval = val
+	return nil
+}
+
+type compressFlag string
+
+func (f *compressFlag) Set(s string) error {
+	s = strings.ToLower(strings.TrimSpace(s))
+	switch s {
+	case "", "none", "-":
+		*f = ""
+		return nil
+	case "gz":
+		s = "gzip"
+	}
+	if _, ok := compressors[s]; !ok {
+		return fmt.Errorf("no such compression method: %q", s)
+	}
+	*f = compressFlag(s)
+	return nil
+}
+
+func (f *compressFlag) String() string {
+	return string(*f)
+}
+
+type suffixFlag string
+
+func (f *suffixFlag) Set(s string) error {
+	switch s = strings.ToLower(strings.TrimSpace(s)); s {
+	case suffixIndex, suffixDate:
+		*f = suffixFlag(s)
+		return nil
+	default:
+		return fmt.Errorf("no such suffix format: %q", s)
+	}
+}
+
+func (f *suffixFlag) String() string {
+	return string(*f)
+}
+
+// signalsFlag is a list of signals that can be forwarded, separated by commas
+// or whitespace, e.g., "HUP,USR1" or "SIGUSR1 SIGUSR2".
+type signalsFlag []os.Signal
+
+func (f *signalsFlag) Set(s string) error {
+	*f = nil
+	s = strings.TrimSpace(s)
+	if s == "-" {
+		return nil
+	}
+	for _, name := range strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	}) {
+		sig, ok := forwardableSignals[strings.TrimPrefix(strings.ToUpper(name), "SIG")]
+		if !ok {
+			return fmt.Errorf("cannot forward signal: %q", name)
+		}
+		*f = append(*f, sig)
+	}
+	return nil
+}
+
+func (f *signalsFlag) String() string {
+	names := make([]string, 0, len(*f))
+	for _, sig := range *f {
+		for name, fsig := range forwardableSignals {
+			if sig == fsig {
+				names = append(names, name)
+			}
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+type restartFlag string
+
+func (f *restartFlag) Set(s string) error {
+	switch s = strings.ToLower(strings.TrimSpace(s)); s {
+	case restartOnFailure, restartAlways:
+		*f = restartFlag(s)
+	case "never", "no", "":
+		*f = ""
+	default:
+		return fmt.Errorf("no such restart mode: %q", s)
+	}
+	return nil
+}
+
+func (f *restartFlag) String() string {
+	return string(*f)
+}
+
+// levelsFlag is a list of rules that classify lines as being of a log level
+// if they match a regexp, e.g., "WARN=deprecated", one per flag.
+type levelsFlag []levelRule
+
+func (f *levelsFlag) Set(s string) error {
+	i := strings.IndexByte(s, '=')
+	if i < 0 {
+		return fmt.Errorf("expected LEVEL=REGEXP: %q", s)
+	}
+	level, ok := levelNames[strings.ToLower(strings.TrimSpace(s[:i]))]
+	if !ok {
+		return fmt.Errorf("no such level: %q", s[:i])
+	}
+	re, err := regexp.Compile(s[i+1:])
+	if err != nil {
+		return err
+	}
+	*f = append(*f, levelRule{level: level, re: re})
+	return nil
+}
+
+func (f *levelsFlag) String() string {
+	rules := make([]string, len(*f))
+	for i, r := range *f {
+		rules[i] = r.level + "=" + r.re.String()
+	}
+	return strings.Join(rules, " ")
+}
+
+type formatFlag string
+
+func (f *formatFlag) Set(s string) error {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if _, ok := recordFormats[s]; !ok && s != formatText {
+		return fmt.Errorf("no such file format: %q", s)
+	}
+	*f = formatFlag(s)
+	return nil
+}
+
+func (f *formatFlag) String() string {
+	return string(*f)
+}
+
 type ansiFlag struct {
 	stdout, stderr, file bool
 }
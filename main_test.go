@@ -2,21 +2,28 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"regexp"
+	"runtime"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/buildkite/shellwords"
 )
 
 func init() {
 	notice = nopNotice
+	renderNotice = nopRenderNotice
 }
 
 func TestInvoke(gt *testing.T) {
@@ -485,6 +492,90 @@ func TestInvoke(gt *testing.T) {
 					`,
 				},
 			},
+			{
+				name: "drop logfiles over the total size limit",
+				args: args("-f log", "--max-size 4b", "--max-total 10b"),
+				input: streams{
+					stdout: `
+					abc
+					def
+					`,
+				},
+				output: streams{
+					stdout: `
+					abc
+					def
+					`,
+				},
+				pre: files{
+					"log.0": "AAAA",
+					"log.1": "BBBB",
+				},
+				post: files{
+					"log":   "def\n",
+					"log.0": "abc\n",
+					"log.1": "AAAA",
+				},
+			},
+			{
+				name: "compress rotated logfiles",
+				args: args("-f log", "--max-size 4b", "--max-count 3", "--compress gzip"),
+				input: streams{
+					stdout: `
+					abc
+					def
+					ghi
+					`,
+				},
+				output: streams{
+					stdout: `
+					abc
+					def
+					ghi
+					`,
+				},
+				pre: files{
+					"log.0": "A",
+				},
+				post: files{
+					"log":      "ghi\n",
+					"log.0.gz": "def\n",
+					"log.1.gz": "abc\n",
+					"log.2":    "A",
+				},
+			},
+			{
+				name: "log streams to separate files",
+				args: args("--stdout-file out", "--stderr-file err", "--stderr-max-size 4b", "--stderr-max-count 1"),
+				input: streams{
+					stdout: `
+					abc
+					def
+					`,
+					stderr: `
+					ABC
+					DEF
+					`,
+				},
+				output: streams{
+					stdout: `
+					abc
+					def
+					`,
+					stderr: `
+					ABC
+					DEF
+					`,
+				},
+				post: files{
+					"out": `
+					abc
+					def
+					`,
+					"err":   "DEF\n",
+					"err.0": "ABC\n",
+				},
+			},
 			{
 				name: "ensure logfile is closed only after writing",
 				args: args("-f log"),
@@ -508,6 +599,41 @@ func TestInvoke(gt *testing.T) {
 					`,
 				},
 			},
+			{
+				name: "restart the command",
+				args: args("--restart always", "--max-restarts 2", "--restart-delay 1ms", "-1 '{restarts} {text}'"),
+				input: streams{
+					stdout: `
+					abc
+					`,
+				},
+				output: streams{
+					stdout: `
+					0 abc
+					1 abc
+					2 abc
+					`,
+				},
+			},
+			{
+				name: "templated logfile path",
+				args: args("-f '{name}.log'"),
+				input: streams{
+					stdout: `
+					abc
+					`,
+				},
+				output: streams{
+					stdout: `
+					abc
+					`,
+				},
+				post: files{
+					"printer.log": `
+					abc
+					`,
+				},
+			},
 			{
 				name: "stdin",
 				args: args("-f log"),
@@ -642,6 +768,338 @@ func TestInvoke(gt *testing.T) {
 	})
 }
 
+func TestNoticeTemplates(gt *testing.T) {
+	t := newCliTest(gt)
+	t.notices()
+	t.In("./testdata", func(t *cliTest) {
+		for _, test := range []struct {
+			name string
+			args string
+			exp  string
+		}{
+			{
+				name: "custom",
+				args: "--start-template 'start {name}' --finish-template '{exit}; {exit code}; {lines}; {bytes}'",
+				exp:  "start stdin\na\nb\nexited with status 0; 0; 2; 4b\n",
+			},
+			{
+				name: "disabled",
+				args: "--start-template= --finish-template=",
+				exp:  "a\nb\n",
+			},
+			{
+				name: "rotation",
+				args: "--start-template= --finish-template= --rotate-template '-- {name}' --max-size 2b",
+				exp:  "-- stdin\nb\n",
+			},
+		} {
+			t.Run(test.name, func(t *cliTest) {
+				t.register("log")
+				args, err := shellwords.Split("-1 '{text}' -f log " + test.args)
+				if err != nil {
+					t.Fatal(err)
+				}
+				var stdout, stderr bytes.Buffer
+				if err := invoke(strings.NewReader("a\nb\n"), &stdout, &stderr, args); err != nil {
+					t.Fatal(err)
+				}
+				if got := t.read("log"); test.exp != got {
+					t.Errorf("\n-%q +%q", test.exp, got)
+				}
+			})
+		}
+	})
+}
+
+// logfmtPair matches the key=value pairs of logfmt records.
+var logfmtPair = regexp.MustCompile(`(\w+)=("(?:[^"\\]|\\.)*"|\S*)`)
+
+func TestFileFormat(gt *testing.T) {
+	// Records are reduced to their stream, name, sequence number and message,
+	// once their timestamp and pid are checked.
+	exp := []string{
+		"logwrap sh 1 started sh",
+		"stdout sh 2 out",
+		"stderr sh 3 err",
+		"logwrap sh 4 done 2",
+	}
+	t := newCliTest(gt)
+	t.requireShell()
+	t.notices()
+	t.In("./testdata", func(t *cliTest) {
+		decodeJSON := func(s string) (map[string]string, error) {
+			var r record
+			if err := json.Unmarshal([]byte(s), &r); err != nil {
+				return nil, err
+			}
+			return map[string]string{
+				"ts":     r.Time.Format(time.RFC3339Nano),
+				"stream": r.Stream,
+				"name":   r.Name,
+				"pid":    strconv.Itoa(r.PID),
+				"seq":    strconv.FormatUint(r.Seq, 10),
+				"msg":    r.Msg,
+			}, nil
+		}
+		decodeLogfmt := func(s string) (map[string]string, error) {
+			r := make(map[string]string)
+			for _, m := range logfmtPair.FindAllStringSubmatch(s, -1) {
+				v := m[2]
+				if strings.HasPrefix(v, `"`) {
+					var err error
+					if v, err = strconv.Unquote(v); err != nil {
+						return nil, err
+					}
+				}
+				r[m[1]] = v
+			}
+			return r, nil
+		}
+		for _, test := range []struct {
+			name   string
+			format string
+			decode func(string) (map[string]string, error)
+			args   []string
+		}{
+			{"json", "json", decodeJSON, nil},
+			{"logfmt", "logfmt", decodeLogfmt, nil},
+			// Only the terminal output follows the templates.
+			{"no stdout template", "json", decodeJSON, []string{"-1", "", "-2", "{text}"}},
+			{"no templates", "json", decodeJSON, []string{"-1", "", "-2", ""}},
+		} {
+			t.Run(test.name, func(t *cliTest) {
+				t.register("log")
+				args := append([]string{
+					"-f", "log", "--file-format", test.format,
+					"--finish-template", "done {lines}",
+				}, test.args...)
+				args = append(args, "--", "sh", "-c", "echo out; sleep 0.1; echo err >&2")
+				if err := invoke(nil, ioutil.Discard, ioutil.Discard, args); err != nil {
+					t.Fatal(err)
+				}
+				var got []string
+				for _, line := range strings.Split(strings.TrimSuffix(t.read("log"), "\n"), "\n") {
+					r, err := test.decode(line)
+					if err != nil {
+						t.Fatalf("%q: %s", line, err)
+					}
+					if ts, err := time.Parse(time.RFC3339Nano, r["ts"]); err != nil || ts.IsZero() {
+						t.Errorf("\n%q: invalid timestamp", line)
+					}
+					if r["stream"] != app && (r["pid"] == "" || r["pid"] == "0") {
+						t.Errorf("\n%q: missing pid", line)
+					}
+					got = append(got, strings.Join([]string{r["stream"], r["name"], r["seq"], r["msg"]}, " "))
+				}
+				if strings.Join(exp, "\n") != strings.Join(got, "\n") {
+					t.Errorf("\n-%q\n+%q", exp, got)
+				}
+			})
+		}
+	})
+}
+
+func TestRestartNotices(gt *testing.T) {
+	t := newCliTest(gt)
+	t.requireShell()
+	t.notices()
+	t.In("./testdata", func(t *cliTest) {
+		for _, test := range []struct {
+			name      string
+			args      []string
+			normalize func(string) string
+			exp       string
+		}{
+			{
+				name: "text",
+				args: []string{"--start-template", "start {restarts}", "--finish-template", "finish {restarts}"},
+				exp:  "start 0\nhi\nfinish 0\nstart 1\nhi\nfinish 1\n",
+			},
+			{
+				name: "disabled",
+				args: []string{"--start-template=", "--finish-template="},
+				exp:  "hi\nhi\n",
+			},
+			{
+				name: "elapsed",
+				args: []string{"--restart-delay", "300ms", "--start-template=", "--finish-template", "{elapsed}"},
+				// Each run takes far less than the delay between them.
+				normalize: func(log string) string {
+					lines := strings.SplitAfter(log, "\n")
+					for i, line := range lines {
+						if d, err := time.ParseDuration(strings.TrimSpace(line)); err == nil {
+							lines[i] = "short\n"
+							if d >= 300*time.Millisecond {
+								lines[i] = "long\n"
+							}
+						}
+					}
+					return strings.Join(lines, "")
+				},
+				exp: "hi\nshort\nhi\nshort\n",
+			},
+			{
+				name: "logfmt",
+				args: []string{"--file-format", "logfmt", "--finish-template", "{bold finish {restarts}}"},
+				// Only keep the fields that don't vary across runs.
+				normalize: func(log string) string {
+					var lines []string
+					for _, line := range strings.SplitAfter(log, "\n") {
+						if i := strings.Index(line, " stream="); i >= 0 {
+							line = line[i+1:]
+						}
+						if i, j := strings.Index(line, " name="), strings.Index(line, " msg="); i >= 0 && j > i {
+							line = line[:i] + line[j:]
+						}
+						lines = append(lines, line)
+					}
+					return strings.Join(lines, "")
+				},
+				exp: "stream=logwrap msg=\"started sh\"\n" +
+					"stream=stdout msg=hi\n" +
+					"stream=logwrap msg=\"finish 0\"\n" +
+					"stream=logwrap msg=\"started sh\"\n" +
+					"stream=stdout msg=hi\n" +
+					"stream=logwrap msg=\"finish 1\"\n",
+			},
+		} {
+			t.Run(test.name, func(t *cliTest) {
+				t.register("log")
+				args := append([]string{"-1", "{text}", "-f", "log", "--restart", "always", "--max-restarts", "1", "--restart-delay", "1ms"}, test.args...)
+				args = append(args, "--", "sh", "-c", "echo hi; exit 1")
+				invoke(nil, ioutil.Discard, ioutil.Discard, args)
+
+				got := t.read("log")
+				if test.normalize != nil {
+					got = test.normalize(got)
+				}
+				if test.exp != got {
+					t.Errorf("\n-%q\n+%q", test.exp, got)
+				}
+			})
+		}
+	})
+}
+
+func TestExitCode(gt *testing.T) {
+	t := newCliTest(gt)
+	t.requireShell()
+	for _, tc := range []struct {
+		args   []string
+		script string
+		code   int
+		err    string
+	}{
+		{nil, "exit 0", 0, ""},
+		{nil, "exit 3", 3, "sh: exited with status 3"},
+		{nil, "kill -9 $$", 137, "sh: killed by signal 9"},
+		{[]string{"--timeout", "50ms"}, "exec sleep 5", 124, "sh: timed out after 50ms (killed by signal 15)"},
+	} {
+		err := invoke(nil, ioutil.Discard, ioutil.Discard, append(tc.args, "--", "sh", "-c", tc.script))
+		if code := exitCode(err); tc.code != code {
+			t.Errorf("\n%s: code: -%d +%d", tc.script, tc.code, code)
+		}
+		var msg string
+		if err != nil {
+			msg = err.Error()
+		}
+		if tc.err != msg {
+			t.Errorf("\n%s: error: -%q +%q", tc.script, tc.err, msg)
+		}
+	}
+}
+
+func TestMulti(gt *testing.T) {
+	t := newCliTest(gt)
+	t.requireShell()
+	// Sessions run concurrently, so their output is compared in sorted order.
+	for _, tc := range []struct {
+		args   []string
+		stdout string
+		code   int
+		err    string
+	}{
+		{
+			[]string{`a=sh -c "echo one"`, `b=sh -c "echo two; exit 2"`},
+			"a green one\nb yellow two\n",
+			2,
+			"b: exited with status 2",
+		},
+		{
+			[]string{`echo one`, `sh -c "echo two"`},
+			"echo green one\nsh yellow two\n",
+			0,
+			"",
+		},
+		{
+			[]string{"--kill-others", `true`, `sh -c "exec sleep 5"`},
+			"",
+			0,
+			"",
+		},
+	} {
+		var (
+			stdout bytes.Buffer
+			args   = append([]string{"-1", "{name} {color} {text}", "--multi"}, tc.args...)
+			start  = time.Now()
+		)
+		err := invoke(nil, &stdout, ioutil.Discard, args)
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("\n%q: sessions ran for %s", tc.args, elapsed)
+		}
+		if code := exitCode(err); tc.code != code {
+			t.Errorf("\n%q: code: -%d +%d", tc.args, tc.code, code)
+		}
+		var msg string
+		if err != nil {
+			msg = err.Error()
+		}
+		if tc.err != msg {
+			t.Errorf("\n%q: error: -%q +%q", tc.args, tc.err, msg)
+		}
+		lines := strings.SplitAfter(stdout.String(), "\n")
+		sort.Strings(lines)
+		if got := strings.Join(lines, ""); tc.stdout != got {
+			t.Errorf("\n%q: stdout: -%q +%q", tc.args, tc.stdout, got)
+		}
+	}
+}
+
+func TestMultiNotices(gt *testing.T) {
+	t := newCliTest(gt)
+	t.requireShell()
+	t.notices()
+	t.In("./testdata", func(t *cliTest) {
+		t.register("log")
+		args := []string{
+			"-1", "{name} {text}", "-f", "log", "--multi",
+			"--start-template", "start {name}", "--finish-template", "finish {name}",
+			"a=echo out", `b=sh -c "echo out; exit 1"`,
+		}
+		invoke(nil, ioutil.Discard, ioutil.Discard, args)
+
+		// Sessions run concurrently, so their lines are compared apart.
+		lines := strings.Split(strings.TrimSuffix(t.read("log"), "\n"), "\n")
+		if exp, got := "start a,b", lines[0]; exp != got {
+			t.Errorf("\n-%q\n+%q", exp, got)
+		}
+		for _, name := range []string{"a", "b"} {
+			var got []string
+			for _, line := range lines {
+				for _, field := range strings.Fields(line) {
+					if field == name {
+						got = append(got, line)
+					}
+				}
+			}
+			exp := []string{"start " + name, name + " out", "finish " + name}
+			if strings.Join(exp, "\n") != strings.Join(got, "\n") {
+				t.Errorf("\n%s: -%q +%q", name, exp, got)
+			}
+		}
+	})
+}
+
 type files map[string]string
 
 func (fs files) has(f string) (ok bool) {
@@ -770,6 +1228,22 @@ func (t *cliTest) env(k, v string) {
 	t.ensure(reset)
 }
 
+// notices makes notice templates render to logfiles until reset, instead of
+// being discarded as they are by default during tests.
+func (t *cliTest) notices() {
+	prev := renderNotice
+	renderNotice = writeNotice
+	t.ensure(func() { renderNotice = prev })
+}
+
+// requireShell skips the test on platforms without a POSIX shell.
+func (t *cliTest) requireShell() {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("requires a POSIX shell")
+	}
+}
+
 func (t *cliTest) pwd() string {
 	t.Helper()
 	wd, err := os.Getwd()
@@ -831,6 +1305,13 @@ func (t *cliTest) read(src interface{}) (res string) {
 		if err == nil {
 			t.register(src)
 		}
+		// Read compressed logfiles transparently.
+		if err == nil && filepath.Ext(src) == ".gz" {
+			var zr *gzip.Reader
+			if zr, err = gzip.NewReader(bytes.NewReader(bs)); err == nil {
+				bs, err = ioutil.ReadAll(zr)
+			}
+		}
 	default:
 		t.Errorf("read: invalid type: %T", src)
 	}
@@ -0,0 +1,79 @@
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalsFlag(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		exp []os.Signal
+		err bool
+	}{
+		{"", nil, false},
+		{"-", nil, false},
+		{"HUP", []os.Signal{syscall.SIGHUP}, false},
+		{"usr1, SIGUSR2", []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}, false},
+		{"WINCH CONT,TSTP", []os.Signal{syscall.SIGWINCH, syscall.SIGCONT, syscall.SIGTSTP}, false},
+		{"KILL", nil, true},
+	} {
+		var f signalsFlag
+		err := f.Set(tc.in)
+		if tc.err != (err != nil) {
+			t.Errorf("\n%q: unexpected error: %v", tc.in, err)
+			continue
+		}
+		if len(tc.exp) != len(f) {
+			t.Errorf("\n%q: -%v +%v", tc.in, tc.exp, f)
+			continue
+		}
+		for i := range f {
+			if tc.exp[i] != f[i] {
+				t.Errorf("\n%q: -%v +%v", tc.in, tc.exp, f)
+				break
+			}
+		}
+	}
+}
+
+func TestSignalGroup(t *testing.T) {
+	// The background sleep keeps the output pipes open, and would thus
+	// outlive the timeout, unless signalled along with the shell.
+	start := time.Now()
+	err := invoke(nil, ioutil.Discard, ioutil.Discard, []string{
+		"--group", "--timeout", "50ms", "--", "sh", "-c", "sleep 5 & wait",
+	})
+	if code := exitCode(err); code != 124 {
+		t.Errorf("\nexit code: -%d +%d", 124, code)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("\nprocess group outlived the timeout by %s", elapsed)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	for _, args := range [][]string{
+		{"--drain-timeout", "50ms"},
+		{"--drain-timeout", "50ms", "--group"},
+		{"--group"},
+		{"--drain-timeout", "50ms", "--pty"},
+	} {
+		if args[len(args)-1] == "--pty" && !ptySupported {
+			continue
+		}
+		start := time.Now()
+		err := invoke(nil, ioutil.Discard, ioutil.Discard, append(args, "--", "sh", "-c", "echo hi; sleep 5 &"))
+		if err != nil {
+			t.Errorf("\n%v: %s", args, err)
+		}
+		if elapsed := time.Since(start); elapsed > 3*time.Second {
+			t.Errorf("\n%v: output was drained for %s", args, elapsed)
+		}
+	}
+}
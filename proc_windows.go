@@ -0,0 +1,18 @@
+// +build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+const processGroupsSupported = false
+
+var forwardableSignals = map[string]os.Signal{}
+
+func setProcessGroup(*exec.Cmd) {}
+
+func signalGroup(p *os.Process, sig os.Signal) error {
+	return p.Signal(sig)
+}
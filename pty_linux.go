@@ -0,0 +1,158 @@
+// +build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"syscall"
+	"unsafe"
+)
+
+const ptySupported = true
+
+// startPty starts cmd on a new pseudo-terminal, which becomes its controlling
+// terminal and standard streams, and returns the master side of it. Standard
+// input is left alone if cmd has none, such that cmd reads EOF from the null
+// device rather than wait for input that never comes. Terminal
+// modes and window size are taken after the terminal that logwrap runs in, if
+// any, and the window size is kept in sync until stop is called.
+func startPty(cmd *exec.Cmd) (pty *os.File, stop func(), err error) {
+	pty, tty, err := openPty()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tty.Close()
+
+	term := findTerminal()
+	if err := setTermios(tty, term); err != nil {
+		pty.Close()
+		return nil, nil, err
+	}
+	if term != nil {
+		resizePty(pty, term)
+	}
+
+	if cmd.Stdin != nil {
+		cmd.Stdin = tty
+	}
+	cmd.Stdout, cmd.Stderr = tty, tty
+	// The terminal is made controlling through the standard output, which,
+	// unlike the standard input, is always attached to it.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 1}
+	if err := cmd.Start(); err != nil {
+		pty.Close()
+		return nil, nil, err
+	}
+
+	// Forward window size changes.
+	var (
+		sigch = make(chan os.Signal, 1)
+		done  = make(chan struct{})
+	)
+	if term != nil {
+		signal.Notify(sigch, syscall.SIGWINCH)
+	}
+	go func() {
+		for {
+			select {
+			case <-sigch:
+				resizePty(pty, term)
+			case <-done:
+				return
+			}
+		}
+	}()
+	stop = func() {
+		signal.Stop(sigch)
+		close(done)
+		pty.Close()
+	}
+	return pty, stop, nil
+}
+
+func openPty() (pty, tty *os.File, err error) {
+	pty, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	var (
+		unlock int32
+		n      uint32
+	)
+	if err = ioctl(pty, syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); err == nil {
+		err = ioctl(pty, syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n)))
+	}
+	if err == nil {
+		tty, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	}
+	if err != nil {
+		pty.Close()
+		return nil, nil, fmt.Errorf("pty: %s", err)
+	}
+	return pty, tty, nil
+}
+
+// findTerminal returns the first standard stream that is a terminal, if any.
+func findTerminal() *os.File {
+	for _, f := range []*os.File{os.Stdin, os.Stdout, os.Stderr} {
+		var t syscall.Termios
+		if ioctl(f, syscall.TCGETS, uintptr(unsafe.Pointer(&t))) == nil {
+			return f
+		}
+	}
+	return nil
+}
+
+// setTermios copies the terminal modes of term, if set, to tty. Echoing is
+// turned off, since input is either piped or echoed by term already, and so
+// is the translation of newlines into CRLF, which would leak into the output.
+func setTermios(tty, term *os.File) error {
+	var t syscall.Termios
+	src := tty
+	if term != nil {
+		src = term
+	}
+	if err := ioctl(src, syscall.TCGETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return fmt.Errorf("pty: %s", err)
+	}
+	t.Lflag &^= syscall.ECHO
+	t.Oflag &^= syscall.ONLCR
+	if err := ioctl(tty, syscall.TCSETS, uintptr(unsafe.Pointer(&t))); err != nil {
+		return fmt.Errorf("pty: %s", err)
+	}
+	return nil
+}
+
+type winsize struct {
+	rows, cols, x, y uint16
+}
+
+func resizePty(pty, term *os.File) {
+	var ws winsize
+	if ioctl(term, syscall.TIOCGWINSZ, uintptr(unsafe.Pointer(&ws))) == nil {
+		ioctl(pty, syscall.TIOCSWINSZ, uintptr(unsafe.Pointer(&ws)))
+	}
+}
+
+// ioctl is like the system call of the same name, but avoids f.Fd(), which
+// would put f into blocking mode and make it impossible to interrupt reads by
+// closing it.
+func ioctl(f *os.File, req, arg uintptr) error {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var errno syscall.Errno
+	if err := rc.Control(func(fd uintptr) {
+		_, _, errno = syscall.Syscall(syscall.SYS_IOCTL, fd, req, arg)
+	}); err != nil {
+		return err
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
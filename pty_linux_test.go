@@ -0,0 +1,38 @@
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestPty(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	args := []string{"--pty", "-1", "{text}", "-2", "[{text}]", "--", "sh", "-c", "[ -t 1 ] && [ -t 2 ] && echo tty; echo err >&2"}
+	if err := invoke(nil, &stdout, &stderr, args); err != nil {
+		t.Fatal(err)
+	}
+	if exp, got := "tty\nerr\n", stdout.String(); exp != got {
+		t.Errorf("\nstdout: -%q +%q", exp, got)
+	}
+	if got := stderr.String(); got != "" {
+		t.Errorf("\nstderr: -%q +%q", "", got)
+	}
+}
+
+func TestPtyWithoutStdin(t *testing.T) {
+	var stdout bytes.Buffer
+	start := time.Now()
+	args := []string{"--pty", "-1", "{text}", "--timeout", "3s", "--", "sh", "-c", "cat; echo done"}
+	if err := invoke(nil, &stdout, &stdout, args); err != nil {
+		t.Fatal(err)
+	}
+	if exp, got := "done\n", stdout.String(); exp != got {
+		t.Errorf("\nstdout: -%q +%q", exp, got)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("\ncommand waited for input for %s", elapsed)
+	}
+}
@@ -0,0 +1,15 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+)
+
+const ptySupported = false
+
+func startPty(*exec.Cmd) (*os.File, func(), error) {
+	return nil, nil, errors.New("pseudo-terminals are only supported on Linux")
+}
@@ -4,10 +4,13 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"math"
 	"os"
 	"os/exec"
 	"os/user"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -23,6 +26,19 @@ import (
 const (
 	defaultStdoutTemplate = `{ts} {fg green [{name}]} {text}`
 	defaultStderrTemplate = `{ts} {fg red [{name}]} {text}`
+
+	// Under --multi, sessions are told apart by color.
+	defaultMultiStdoutTemplate = `{ts} {fg {color} [{name}]} {text}`
+
+	// Notices are prefixed in text logfiles only, since records carry their
+	// own timestamp.
+	defaultStartNotice    = `started {bold {name}}`
+	defaultFinishNotice   = `finished {bold {name}} after {elapsed}/{bytes} ({exit})`
+	defaultRotateNotice   = `logfile turned over`
+	defaultNoticePrefix   = `{ts} ` + app + `: `
+	defaultStartTemplate  = defaultNoticePrefix + defaultStartNotice
+	defaultFinishTemplate = defaultNoticePrefix + defaultFinishNotice
+	defaultRotateTemplate = defaultNoticePrefix + defaultRotateNotice
 )
 
 func newTemplate(name, text string, ps placeholders) (*template, error) {
@@ -32,7 +48,8 @@ func newTemplate(name, text string, ps placeholders) (*template, error) {
 			text:         text,
 			elems:        make([]templateElem, 0, 6),
 			placeholders: ps,
-			cache:        make(map[string]*cachedPlaceholder),
+			cache:        make(map[string]*cachedValue),
+			regexps:      make(map[string]*regexp.Regexp),
 		}
 		p = &templateParser{
 			template: t,
@@ -63,6 +80,10 @@ var (
 	errUnexpectedClosingDelimiter = errors.New("unexpected closing delimiter")
 	errUnterminatedPlaceholder    = errors.New("unterminated placeholder")
 	errExpectedSpace              = errors.New("expected a space character")
+
+	// errNoValue is rendered by placeholders that have no value (yet), such
+	// as {pid} before the command is started.
+	errNoValue = errors.New("n/a")
 )
 
 const eof rune = -1
@@ -114,6 +135,7 @@ func (p *templateParser) parsePlaceholder() (templateElem, error) {
 	}
 
 	p.skipWhitespace()
+	argPos := p.pos
 PARSE:
 	for {
 		switch r := p.next(); r {
@@ -146,7 +168,8 @@ PARSE:
 			if sb.Len() > 0 {
 				elems = append(elems, textElem(sb.String()))
 			}
-			return &nestedPlaceholderElem{name, elems}, nil
+			elem := &nestedPlaceholderElem{name, elems}
+			return elem, p.compileRegexp(argPos, elem)
 		}
 	}
 
@@ -154,13 +177,195 @@ PARSE:
 	res := &placeholderElem{name: name}
 	if sb.Len() > 0 {
 		s := sb.String()
-		args, err := shellwords.SplitPosix(s)
+		args, err := p.splitArgs(name, s)
 		if err != nil {
 			return nil, p.errAt(pos+1, fmt.Errorf("placeholder arguments contain unbalanced quotes"))
 		}
 		res.args = args
 	}
-	return res, nil
+	return res, p.compileRegexp(argPos, res)
+}
+
+// compileRegexp compiles the regexp taken as first argument by elem, if it is
+// a regexpPlaceholder, or matched against by the condition of {if}, such that
+// it is compiled once, rather than on every render, unless it is the output of
+// other placeholders.
+func (p *templateParser) compileRegexp(pos int, elem templateElem) error {
+	var (
+		expr string
+		ok   bool
+	)
+	switch elem := elem.(type) {
+	case *placeholderElem:
+		if elem.name == "if" {
+			expr, ok = conditionRegexp(elem.args)
+		} else if _, ok = p.get(elem.name).(regexpPlaceholder); ok && len(elem.args) > 0 {
+			expr = elem.args[0]
+		}
+	case *nestedPlaceholderElem:
+		if elem.name == "if" {
+			// Inner placeholders are only known at render time, so they're
+			// stood in for by a NUL, and regexps that contain any are skipped.
+			var sb strings.Builder
+			for _, e := range elem.elems {
+				if text, ok := e.(textElem); ok {
+					sb.WriteString(string(text))
+				} else {
+					sb.WriteByte(0)
+				}
+			}
+			if args, err := p.splitArgs("if", sb.String()); err == nil {
+				expr, ok = conditionRegexp(args)
+				ok = ok && !strings.ContainsRune(expr, 0)
+			}
+		} else if _, ok = p.get(elem.name).(regexpPlaceholder); ok {
+			var text textElem
+			if text, ok = elem.elems[0].(textElem); ok {
+				expr, ok = p.firstWord(elem.name, string(text))
+			}
+		}
+	}
+	if !ok {
+		return nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return p.errAt(pos, err)
+	}
+	p.regexps[expr] = re
+	return nil
+}
+
+// firstWord returns the first argument of the placeholder called name in s,
+// provided that it is followed by whitespace, i.e., that it does not continue
+// past s.
+func (ps placeholders) firstWord(name, s string) (string, bool) {
+	var (
+		quote   rune
+		escaped bool
+	)
+	s = strings.TrimLeftFunc(s, unicode.IsSpace)
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case unicode.IsSpace(r):
+			words, err := ps.splitArgs(name, s[:i])
+			if err != nil || len(words) != 1 {
+				return "", false
+			}
+			return words[0], true
+		}
+	}
+	return "", false
+}
+
+// splitArgs splits the arguments of the placeholder called name into words,
+// as a POSIX shell would. Only the operands of {if} keep empty quoted words,
+// such that, e.g., '{pid}' is an operand of its own even if {pid} is empty.
+// Regexp operands are the exception, in that backslashes are kept as-is,
+// unless they escape quotes or other backslashes, such that, e.g., '\d+'
+// needs no further escaping.
+func (ps placeholders) splitArgs(name, s string) (words []string, err error) {
+	if name == "if" {
+		words, err = splitWords(s, true, false)
+	} else {
+		words, err = shellwords.SplitPosix(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if i := ps.regexpArg(name, words); i >= 0 {
+		// Backslashes don't affect word boundaries, so words line up.
+		if literal, err := splitWords(s, name == "if", true); err == nil && len(literal) == len(words) {
+			words[i] = literal[i]
+		}
+	}
+	return words, nil
+}
+
+// regexpArg returns the index of the regexp among the arguments of the
+// placeholder called name, i.e., the first argument of regexpPlaceholders,
+// or the right-hand side of a match in the condition of {if}, if any, or -1.
+func (ps placeholders) regexpArg(name string, args []string) int {
+	if name == "if" {
+		i := 0
+		if len(args) > 0 && args[0] == "!" {
+			i++
+		}
+		if len(args) >= i+3 && (args[i+1] == "=~" || args[i+1] == "!~") {
+			return i + 2
+		}
+		return -1
+	}
+	if _, ok := ps.get(name).(regexpPlaceholder); ok && len(args) > 0 {
+		return 0
+	}
+	return -1
+}
+
+// splitWords splits s into words, keeping empty quoted ones if keepEmpty is
+// set. If literal is set, backslashes only escape quotes and other
+// backslashes, as well as whitespace outside of quotes.
+func splitWords(s string, keepEmpty, literal bool) ([]string, error) {
+	var (
+		words   = []string{}
+		word    strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for _, r := range s {
+		switch {
+		case escaped:
+			switch {
+			case !literal:
+			case r == '\\', r == '\'', r == '"':
+			case quote == 0 && unicode.IsSpace(r):
+			default:
+				word.WriteByte('\\')
+			}
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inWord && (word.Len() > 0 || keepEmpty) {
+				words = append(words, word.String())
+			}
+			word.Reset()
+			inWord = false
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("expected closing quote %c", quote)
+	}
+	if escaped && literal {
+		word.WriteByte('\\')
+	}
+	if inWord && (word.Len() > 0 || keepEmpty) {
+		words = append(words, word.String())
+	}
+	return words, nil
 }
 
 func (p *templateParser) parsePlaceholderName() (string, error) {
@@ -254,14 +459,27 @@ type template struct {
 	text  string
 	elems []templateElem
 	placeholders
-	cache map[string]*cachedPlaceholder
+	cache   map[string]*cachedValue   // cleared after each render
+	regexps map[string]*regexp.Regexp // compiled at parse time
+
+	strict bool  // see renderStrict
+	failed error // first placeholder error of a strict render
+	path   bool  // see renderPath
+
+	conditional bool  // rendering the operands of {if}, see apply
+	noValue     bool  // set if a placeholder within the operands of {if} has no value
+	condFailed  error // first placeholder error within the operands of {if}
 }
 
 func (t *template) render(w io.Writer, text []byte) (n int, err error) {
 	defer t.dropCache()
 	for _, elem := range t.elems {
+		out := w
+		if _, ok := elem.(textElem); t.path && !ok {
+			out = &pathEscaper{Writer: w}
+		}
 		var c int
-		c, err = t.renderElem(w, text, elem)
+		c, err = t.renderElem(out, text, elem)
 		n += c
 		if err != nil {
 			return
@@ -278,11 +496,22 @@ func (t *template) renderElem(w io.Writer, text []byte, elem templateElem) (n in
 		switch elem.name {
 		case "text":
 			n, err = w.Write(text)
+		case "stream":
+			n, err = io.WriteString(w, t.name)
 		default:
-			s := t.apply(elem.name, elem.args)
+			s := t.apply(elem.name, elem.args, text)
 			n, err = io.WriteString(w, s)
 		}
 	case *nestedPlaceholderElem:
+		// Within the operands of {if}, placeholders without a value are
+		// empty, as are those that take any of them as arguments, such that,
+		// e.g., {if '{upcase {pid}}' ...} tests whether {pid} is set. Any other
+		// error fails {if} as a whole.
+		conditional, noValue, condFailed := t.conditional, t.noValue, t.condFailed
+		if elem.name == "if" {
+			t.conditional, t.condFailed = true, nil
+		}
+		t.noValue = false
 		var args strings.Builder
 		for _, arg := range elem.elems {
 			switch arg := arg.(type) {
@@ -291,19 +520,27 @@ func (t *template) renderElem(w io.Writer, text []byte, elem templateElem) (n in
 			default:
 				// Render inner placeholders into <args>, ensuring quotes are escaped.
 				if _, err = t.renderElem(&quoteEscaper{Writer: &args}, text, arg); err != nil {
+					t.conditional, t.noValue, t.condFailed = conditional, noValue, condFailed
 					return
 				}
 			}
 		}
+		missing, failed := t.noValue && elem.name != "if", t.condFailed
+		t.conditional, t.noValue, t.condFailed = conditional, noValue || missing, condFailed
 
 		var s string
 		{
 			s = args.String()
-			args, err := shellwords.SplitPosix(s)
-			if err != nil {
+			args, err := t.splitArgs(elem.name, s)
+			switch {
+			case err != nil:
 				s = fmt.Sprintf("{%s: bad quoting in: %s}", elem.name, s)
-			} else {
-				s = t.apply(elem.name, args)
+			case missing:
+				s = ""
+			case elem.name == "if" && failed != nil:
+				s = t.fail(elem.name, failed)
+			default:
+				s = t.apply(elem.name, args, text)
 			}
 		}
 		if len(s) > 0 {
@@ -321,18 +558,50 @@ func (t *template) renderString(s string) (string, error) {
 	return out.String(), nil
 }
 
-func (t *template) apply(name string, args []string) (s string) {
+// renderStrict is like renderString, except that placeholders that fail to
+// render, e.g., for lack of a value, fail the whole render.
+func (t *template) renderStrict(s string) (string, error) {
+	t.strict, t.failed = true, nil
+	defer func() { t.strict, t.failed = false, nil }()
+	res, err := t.renderString(s)
+	if err == nil && t.failed != nil {
+		return "", t.failed
+	}
+	return res, err
+}
+
+// renderPath is like renderStrict, except that path separators are replaced
+// in the output of placeholders, such that, e.g., {ts date} doesn't introduce
+// directories of its own when the template is rendered as a file path.
+func (t *template) renderPath() (string, error) {
+	t.path = true
+	defer func() { t.path = false }()
+	return t.renderStrict("")
+}
+
+func (t *template) apply(name string, args []string, text []byte) (s string) {
 	var err error
 APPLY:
 	p := t.get(name)
 	if p == nil {
-		err = errors.New("n/a")
+		err = errNoValue
 	} else if err = t.check(name, args); err == nil {
 		switch p := p.(type) {
 		case placeholderFunc:
 			s, err = p(args)
 		case cyclicPlaceholder:
-			s, err = t.tryCache(name, p, args)
+			var v interface{}
+			v, err = t.tryCache(name+strings.Join(args, ""), func() (interface{}, error) {
+				return p(args)
+			})
+			s, _ = v.(string)
+		case linePlaceholder:
+			s, err = p(&line{text: string(text), template: t}, args)
+		case regexpPlaceholder:
+			var re *regexp.Regexp
+			if re, err = t.compile(args[0]); err == nil {
+				s, err = p(re, string(text), args[1:])
+			}
 		case placeholderMaker:
 			t.set(name, p(args))
 			goto APPLY
@@ -340,50 +609,144 @@ APPLY:
 			panic(fmt.Sprintf("%s: unexpected placeholder type: %T", name, p))
 		}
 	}
-	if err != nil {
-		s = fmt.Sprintf("{%s: %s}", name, err)
+	switch {
+	case err == nil:
+	case err == errNoValue && t.conditional:
+		// Placeholders without a value are empty operands of {if}.
+		t.noValue = true
+		return ""
+	case t.conditional:
+		// Other errors are reported by {if} itself.
+		if t.condFailed == nil {
+			t.condFailed = fmt.Errorf("{%s}: %s", name, err)
+		}
+		return ""
+	default:
+		s = t.fail(name, err)
 	}
 	return
 }
 
-func (t *template) tryCache(name string, p placeholder, args []string) (s string, err error) {
-	id := name + strings.Join(args, "")
-	cache, ok := t.cache[id]
-	if ok {
-		return cache.string, cache.error
+// fail returns the error text that the placeholder called name renders as,
+// failing the render if strict.
+func (t *template) fail(name string, err error) string {
+	if t.strict && t.failed == nil {
+		if err == errNoValue {
+			t.failed = fmt.Errorf("{%s} has no value", name)
+		} else {
+			t.failed = fmt.Errorf("{%s}: %s", name, err)
+		}
 	}
+	return fmt.Sprintf("{%s: %s}", name, err)
+}
 
-	switch p := p.(type) {
-	case cyclicPlaceholder:
-		s, err = p(args)
-	default:
-		panic(fmt.Sprintf("unexpected placeholder type: %T", p))
+// compile returns the compiled form of expr, which is looked up among the
+// regexps compiled at parse time first.
+func (t *template) compile(expr string) (*regexp.Regexp, error) {
+	if re, ok := t.regexps[expr]; ok {
+		return re, nil
 	}
-	t.cache[id] = &cachedPlaceholder{
-		placeholder: p,
-		string:      s,
-		error:       err,
+	return regexp.Compile(expr)
+}
+
+// tryCache returns the result of fn, which is called once per render cycle
+// for a given id, after which the result is cached until the cycle ends.
+func (t *template) tryCache(id string, fn func() (interface{}, error)) (interface{}, error) {
+	if cache, ok := t.cache[id]; ok {
+		return cache.value, cache.error
 	}
-	return
+	v, err := fn()
+	t.cache[id] = &cachedValue{value: v, error: err}
+	return v, err
 }
 
 func (t *template) dropCache() {
-	for name, cache := range t.cache {
-		switch cache.placeholder.(type) {
-		case cyclicPlaceholder:
-			delete(t.cache, name)
-		default:
-			panic(fmt.Sprintf("%s: uncacheable placeholder type: %T", name, cache.placeholder))
-		}
+	for id := range t.cache {
+		delete(t.cache, id)
 	}
 }
 
-type cachedPlaceholder struct {
-	placeholder
-	string
+type cachedValue struct {
+	value interface{}
 	error
 }
 
+// line is the line of text being rendered, as passed to linePlaceholders.
+type line struct {
+	text string
+	*template
+}
+
+// parse returns the result of parsing the line using fn, which is shared by
+// all placeholders that parse it with the same id during the render cycle.
+func (l *line) parse(id string, fn func(string) (interface{}, error)) (interface{}, error) {
+	return l.tryCache("line:"+id, func() (interface{}, error) {
+		return fn(l.text)
+	})
+}
+
+// subexpIndex returns the index of the group of re identified by its number
+// or name, or -1 if there is no such group.
+func subexpIndex(re *regexp.Regexp, id string) int {
+	if n, err := strconv.Atoi(id); err == nil {
+		if n < 0 || n > re.NumSubexp() {
+			return -1
+		}
+		return n
+	}
+	for i, name := range re.SubexpNames() {
+		if name != "" && name == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// evalCondition evaluates the condition at the start of args, as accepted by
+// {if}, and returns its result along with the remaining arguments. Regexps
+// are compiled using compile.
+func evalCondition(args []string, compile func(string) (*regexp.Regexp, error)) (ok bool, rest []string, err error) {
+	negate := len(args) > 0 && args[0] == "!"
+	if negate {
+		args = args[1:]
+	}
+	if len(args) == 0 {
+		return false, nil, errors.New("missing condition")
+	}
+	var op string
+	if len(args) >= 3 {
+		op = args[1]
+	}
+	switch op {
+	case "==", "!=":
+		ok = (args[0] == args[2]) == (op == "==")
+		args = args[3:]
+	case "=~", "!~":
+		re, err := compile(args[2])
+		if err != nil {
+			return false, nil, err
+		}
+		ok = re.MatchString(args[0]) == (op == "=~")
+		args = args[3:]
+	default:
+		ok = args[0] != ""
+		args = args[1:]
+	}
+	return ok != negate, args, nil
+}
+
+// conditionRegexp returns the regexp of the condition at the start of args,
+// if it is a match.
+func conditionRegexp(args []string) (string, bool) {
+	if len(args) > 0 && args[0] == "!" {
+		args = args[1:]
+	}
+	if len(args) >= 3 && (args[1] == "=~" || args[1] == "!~") {
+		return args[2], true
+	}
+	return "", false
+}
+
 func (t *template) String() string {
 	var sb strings.Builder
 	for _, elem := range t.elems {
@@ -455,11 +818,20 @@ type (
 
 	// placeholderMaker creates other placeholders at render time.
 	placeholderMaker func([]string) placeholder
+
+	// linePlaceholder is called with the line of text being rendered.
+	linePlaceholder func(*line, []string) (string, error)
+
+	// regexpPlaceholder is called with its first argument compiled as a
+	// regexp, the line of text being rendered, and the rest of its arguments.
+	regexpPlaceholder func(re *regexp.Regexp, text string, args []string) (string, error)
 )
 
 func (placeholderFunc) placeholder()   {}
 func (placeholderMaker) placeholder()  {}
 func (cyclicPlaceholder) placeholder() {}
+func (regexpPlaceholder) placeholder() {}
+func (linePlaceholder) placeholder()   {}
 
 type placeholders map[string]placeholder
 
@@ -511,12 +883,26 @@ type placeholderDef struct {
 	fn    placeholder
 }
 
+// regexpHelp is shared by the help of placeholders that take regexps.
+const regexpHelp = `See https://golang.org/pkg/regexp/syntax/ for the syntax of
+regexps, which are compiled once, unless they are the output
+of other placeholders. Unlike in other placeholder arguments,
+backslashes are kept as-is in regexps, unless they escape quotes
+or other backslashes.`
+
 func init() {
 	var (
 		color = func(kind, id, text string) (string, error) {
-			c, ok := codes[kind][strings.ToLower(strings.TrimSpace(id))]
-			if !ok {
-				return "", fmt.Errorf("no such color: %s", id)
+			id = strings.ToLower(strings.TrimSpace(id))
+			if id == "auto" {
+				if text == "" {
+					return "", errors.New("auto color requires text")
+				}
+				return hashColor(kind, text).wrap(text), nil
+			}
+			c, err := parseColor(kind, id)
+			if err != nil {
+				return "", err
 			}
 			if text == "" {
 				return c.String(), nil
@@ -535,6 +921,8 @@ func init() {
 			return c.wrap(text), nil
 		}
 
+		level, levelcolor = levelPlaceholders(nil)
+
 		fg = func(id, text string) (string, error) { return color("fg", id, text) }
 		bg = func(id, text string) (string, error) { return color("bg", id, text) }
 
@@ -623,6 +1011,21 @@ func init() {
 				return h, nil
 			},
 		},
+		{
+			"stream",
+			func() (string, placeholder) {
+				h := `
+				Outputs the name of the stream the line of text originates from.
+
+				{{usage}}
+
+				{{.self}} is either "stdout" or "stderr", or, outside of the
+				{{flag "stdout"}} and {{flag "stderr"}} templates, the name of the
+				template being rendered, e.g., "finish-template".
+				`
+				return h, nil
+			},
+		},
 		{
 			"path",
 			func() (string, placeholder) {
@@ -776,6 +1179,21 @@ func init() {
 				})
 			},
 		},
+		{
+			"color",
+			func() (string, placeholder) {
+				h := `
+				Outputs the color assigned to the session.
+
+				{{usage}}
+
+				Under {{flag "multi"}}, each session is assigned a different color,
+				which the default {{flag "stdout"}} template uses for the session name.
+				Otherwise, {{.self}} outputs "green".
+				`
+				return h, nil
+			},
+		},
 		{
 			"pid",
 			func() (string, placeholder) {
@@ -800,6 +1218,72 @@ func init() {
 				})
 			},
 		},
+		{
+			"exit",
+			func() (string, placeholder) {
+				h := `
+				Outputs the exit status of the underlying command.
+
+				{{usage "[code]"}}
+
+				{{arg "code"}}: prints the numeric exit code instead, which is 128 plus the
+				signal number if the command was killed by a signal
+
+				If no argument is provided, it prints a description of the
+				exit status (e.g., {{val "exited with status 2"}} or {{val "killed by signal 9"}}),
+				or of the error that caused {{.app}} to fail. It is only meaningful in
+				{{flag "finish-template"}}.
+				`
+				return h, nil
+			},
+		},
+		{
+			"elapsed",
+			func() (string, placeholder) {
+				h := `
+				Outputs the time elapsed since {{.app}} was initialized, or since
+				the command was last restarted.
+
+				{{usage}}
+				`
+				return h, nil
+			},
+		},
+		{
+			"bytes",
+			func() (string, placeholder) {
+				h := `
+				Outputs the number of bytes output by the underlying command so far.
+
+				{{usage}}
+				`
+				return h, nil
+			},
+		},
+		{
+			"lines",
+			func() (string, placeholder) {
+				h := `
+				Outputs the number of lines output by the underlying command so far.
+
+				{{usage}}
+				`
+				return h, nil
+			},
+		},
+		{
+			"restarts",
+			func() (string, placeholder) {
+				h := `
+				Outputs the number of times the underlying command was restarted.
+
+				{{usage}}
+
+				It is only meaningful with {{flag "restart"}}.
+				`
+				return h, nil
+			},
+		},
 		{
 			"cmd",
 			func() (string, placeholder) {
@@ -868,6 +1352,213 @@ func init() {
 				return h, justifier('l')
 			},
 		},
+		{
+			"if",
+			func() (string, placeholder) {
+				h := `
+				Outputs <then> if <condition> holds, or <else> otherwise, if set.
+
+				{{usage "<condition> <arguments...>"}}
+
+				<arguments...> are <then> and, optionally, <else>, while
+				<condition> is either a single value, which holds if not empty,
+				or a comparison of two values:
+
+				{{arg "<a> == <b>"}}: holds if the values are equal
+				{{arg "<a> != <b>"}}: holds if the values differ
+				{{arg "<a> =~ <regexp>"}}: holds if <a> matches <regexp>
+				{{arg "<a> !~ <regexp>"}}: holds if <a> does not match <regexp>
+
+				Any condition is negated if preceded by "!". Placeholders
+				without a value, such as {pid} before the command is started,
+				are empty within {{.self}}, as are placeholders that take them
+				as arguments. Values that may be empty or contain
+				whitespace, such as {text}, should be quoted, e.g.:
+
+				{if '{text}' =~ ERROR '{fg red {text}}' '{text}'}
+				{if '{pid}' '[{pid}] '}
+				{if {stream} == stderr '{bold {text}}' '{text}'}
+				`
+				return h, linePlaceholder(func(l *line, args []string) (string, error) {
+					ok, args, err := evalCondition(args, l.compile)
+					switch {
+					case err != nil:
+						return "", err
+					case len(args) == 0 || len(args) > 2:
+						return "", errors.New("expected <then> [<else>] after the condition")
+					case ok:
+						return args[0], nil
+					case len(args) == 2:
+						return args[1], nil
+					}
+					return "", nil
+				})
+			},
+		},
+		{
+			"match",
+			func() (string, placeholder) {
+				h := `
+				Outputs the first match of a regexp, or of one of its groups.
+
+				{{usage "<regexp> [<group>] [<arguments...>]"}}
+
+				<group> is either the number or the name of a group, and
+				defaults to 0, i.e., the whole match. The regexp is matched
+				against <arguments...>, if set, or the line of text otherwise,
+				and {{.self}} outputs nothing if it does not match, e.g.:
+
+				{match 'id=(\d+)' 1}
+				{match '(?P<user>\w+)@' user '{env USER}@{host}'}
+
+				{{.regexps}}
+				`
+				return h, regexpPlaceholder(func(re *regexp.Regexp, text string, args []string) (string, error) {
+					group := 0
+					if len(args) > 0 {
+						group = subexpIndex(re, args[0])
+						if group < 0 {
+							return "", fmt.Errorf("no such group: %s", args[0])
+						}
+						if len(args) > 1 {
+							text = strings.Join(args[1:], " ")
+						}
+					}
+					m := re.FindStringSubmatchIndex(text)
+					if m == nil || m[2*group] < 0 {
+						return "", nil
+					}
+					return text[m[2*group]:m[2*group+1]], nil
+				})
+			},
+		},
+		{
+			"replace",
+			func() (string, placeholder) {
+				h := `
+				Replaces all matches of a regexp.
+
+				{{usage "<regexp> <replacement> [<arguments...>]"}}
+
+				Matches are replaced in <arguments...>, if set, or in the line
+				of text otherwise. Within <replacement>, $1 or ${1} stand for
+				the text matched by the first group, $name or ${name} for that
+				of a named group, and so on, e.g.:
+
+				{replace '(ERROR|WARN)' '{fg red $1}'}
+				{replace '\s+' ' ' '{text}'}
+
+				{{.regexps}}
+				`
+				return h, regexpPlaceholder(func(re *regexp.Regexp, text string, args []string) (string, error) {
+					if len(args) > 1 {
+						text = strings.Join(args[1:], " ")
+					}
+					return re.ReplaceAllString(text, args[0]), nil
+				})
+			},
+		},
+		{
+			"level",
+			func() (string, placeholder) {
+				h := `
+				Outputs the log level of the line of text.
+
+				{{usage "[<default>]"}}
+
+				The level is one of ERROR, WARN, INFO, DEBUG or TRACE, and is
+				detected using common patterns, such as "level=warn" or
+				"[WARN]", JSON fields such as "level":"warn", and glog-style
+				prefixes, such as "W1016". Patterns can be added via
+				{{flag "level"}}, which take precedence. If no level is detected,
+				{{.self}} outputs <default>, if set.
+				`
+				return h, level
+			},
+		},
+		{
+			"levelcolor",
+			func() (string, placeholder) {
+				h := `
+				Sets the foreground color of text after the log level of the line.
+
+				{{usage "<arguments...>"}}
+
+				ERROR is rendered in red, WARN in yellow, INFO in green, DEBUG
+				in blue, and TRACE in dark gray. The text is left as is if no
+				level is detected. {{also "{level}"}}
+				`
+				return h, levelcolor
+			},
+		},
+		{
+			"json",
+			func() (string, placeholder) {
+				h := `
+				Outputs a field of the line of text, if it is JSON.
+
+				{{usage "<path> [<arguments...>]"}}
+
+				<path> is made up of object keys and array indices, each
+				preceded by a dot, e.g., .msg, .http.status or .items.0.id,
+				while "." alone stands for the whole line. Strings and numbers
+				are output as they are, and objects and arrays as compact JSON.
+				If the line is not JSON, or the field is missing or null,
+				{{.self}} outputs <arguments...>, if set, e.g.:
+
+				{json .msg '{text}'}
+
+				The line is parsed once, regardless of how many times {{.self}}
+				is used in the template. {{also "{kv}"}}
+				`
+				return h, linePlaceholder(func(l *line, args []string) (string, error) {
+					def := strings.Join(args[1:], " ")
+					v, err := l.parse("json", parseJSON)
+					if err != nil {
+						return def, nil
+					}
+					if v, ok := lookupJSON(v, args[0]); ok && v != nil {
+						return formatJSON(v), nil
+					}
+					return def, nil
+				})
+			},
+		},
+		{
+			"kv",
+			func() (string, placeholder) {
+				h := `
+				Outputs the value of a key=value pair of the line of text.
+
+				{{usage "<key> [<arguments...>]"}}
+
+				Lines are parsed as written by logfmt-style loggers, e.g.,
+				Go's log/slog text handler or the Heroku router, such as:
+
+				time=2021-02-16T12:00:00Z level=INFO msg="hello \"world\"" status=200
+
+				Quoted values are unquoted, along with any escape sequences
+				within them. If the key is missing, {{.self}} outputs
+				<arguments...>, if set, e.g.:
+
+				{kv msg '{text}'}
+
+				The line is parsed once, regardless of how many times {{.self}}
+				is used in the template. {{also "{json}"}}
+				`
+				return h, linePlaceholder(func(l *line, args []string) (string, error) {
+					def := strings.Join(args[1:], " ")
+					v, err := l.parse("kv", parseLogfmt)
+					if err != nil {
+						return def, nil
+					}
+					if val, ok := v.(map[string]string)[args[0]]; ok {
+						return val, nil
+					}
+					return def, nil
+				})
+			},
+		},
 		{
 			"upcase",
 			func() (string, placeholder) {
@@ -901,6 +1592,11 @@ func init() {
 				Sets the background color of text.
 
 				{{usage "<color> [<arguments...>]"}}
+
+				<color> is a name, an index in the 256-color palette or an RGB
+				value (see --help colors), or "auto", which picks a color from a
+				hash of the text, such that the same text is always rendered in
+				the same color.
 				`
 				return h, placeholderFunc(func(args []string) (string, error) {
 					id, args := args[0], args[1:]
@@ -916,6 +1612,11 @@ func init() {
 				Sets the foreground color of text.
 
 				{{usage "<color> [<arguments...>]"}}
+
+				<color> is a name, an index in the 256-color palette or an RGB
+				value (see --help colors), or "auto", which picks a color from a
+				hash of the text, such that the same text is always rendered in
+				the same color.
 				`
 				return h, placeholderFunc(func(args []string) (string, error) {
 					id, args := args[0], args[1:]
@@ -1019,6 +1720,7 @@ func init() {
 				"self":      fmt.Sprintf("{%s}", name),
 				"app":       app,
 				"timestamp": timestampEnvVar,
+				"regexps":   regexpHelp,
 			}
 		)
 
@@ -1157,17 +1859,282 @@ func (cs ansiCodes) keys(kind string) (res []string) {
 	return
 }
 
+// parseColor returns the ANSI code of a color of the given kind ("fg" or
+// "bg"), which is identified by name, by its index in the 256-color palette,
+// or by its RGB value, as #rgb, #rrggbb or rgb(r,g,b). Colors are emitted as
+// given, unless limited to fewer by colorDepth, in which case they are
+// replaced by the closest ones available.
+func parseColor(kind, id string) (ansiCode, error) {
+	if c, ok := codes[kind][id]; ok {
+		return c, nil
+	}
+	depth := colorDepth()
+	if depth == 0 {
+		depth = 1 << 24
+	}
+	if n, err := strconv.ParseUint(id, 10, 8); err == nil {
+		return indexColor(kind, int(n), depth), nil
+	}
+	if c, ok := parseRGB(id); ok {
+		return rgbColor(kind, c, depth), nil
+	}
+	return "", fmt.Errorf("no such color: %s", id)
+}
+
+type rgb [3]int
+
+func parseRGB(s string) (c rgb, ok bool) {
+	var parts []string
+	switch {
+	case strings.HasPrefix(s, "#") && len(s) == 4:
+		for _, r := range s[1:] {
+			parts = append(parts, strings.Repeat(string(r), 2))
+		}
+	case strings.HasPrefix(s, "#") && len(s) == 7:
+		parts = []string{s[1:3], s[3:5], s[5:7]}
+	case strings.HasPrefix(s, "rgb(") && strings.HasSuffix(s, ")"):
+		parts = strings.Split(s[4:len(s)-1], ",")
+		if len(parts) != 3 {
+			return c, false
+		}
+		for i, p := range parts {
+			n, err := strconv.ParseUint(strings.TrimSpace(p), 10, 8)
+			if err != nil {
+				return c, false
+			}
+			c[i] = int(n)
+		}
+		return c, true
+	default:
+		return c, false
+	}
+	for i, p := range parts {
+		n, err := strconv.ParseUint(p, 16, 8)
+		if err != nil {
+			return c, false
+		}
+		c[i] = int(n)
+	}
+	return c, true
+}
+
+// basicColors are the RGB values of the 16 basic colors, as rendered by
+// xterm, which stand in for the actual ones when looking for the closest
+// color.
+var basicColors = [16]rgb{
+	{0, 0, 0}, {205, 0, 0}, {0, 205, 0}, {205, 205, 0},
+	{0, 0, 238}, {205, 0, 205}, {0, 205, 205}, {229, 229, 229},
+	{127, 127, 127}, {255, 0, 0}, {0, 255, 0}, {255, 255, 0},
+	{92, 92, 255}, {255, 0, 255}, {0, 255, 255}, {255, 255, 255},
+}
+
+// cubeLevels are the intensities of each component of the 6x6x6 color cube
+// of the 256-color palette.
+var cubeLevels = [6]int{0, 95, 135, 175, 215, 255}
+
+// basicColor returns the ANSI code of the nth basic color.
+func basicColor(kind string, n int) ansiCode {
+	base := 30
+	if kind == "bg" {
+		base = 40
+	}
+	if n >= 8 {
+		base, n = base+60, n-8
+	}
+	return ansiCode(strconv.Itoa(base + n))
+}
+
+func colorPrefix(kind string) string {
+	if kind == "bg" {
+		return "48"
+	}
+	return "38"
+}
+
+func indexColor(kind string, n, depth int) ansiCode {
+	switch {
+	case n < 16:
+		return basicColor(kind, n)
+	case depth >= 256:
+		return ansiCode(fmt.Sprintf("%s;5;%d", colorPrefix(kind), n))
+	default:
+		return basicColor(kind, closestColor(paletteRGB(n), basicColors[:]))
+	}
+}
+
+func rgbColor(kind string, c rgb, depth int) ansiCode {
+	switch {
+	case depth > 256:
+		return ansiCode(fmt.Sprintf("%s;2;%d;%d;%d", colorPrefix(kind), c[0], c[1], c[2]))
+	case depth == 256:
+		return indexColor(kind, closestIndex(c), depth)
+	default:
+		return basicColor(kind, closestColor(c, basicColors[:]))
+	}
+}
+
+// paletteRGB returns the RGB value of the nth color of the 256-color palette.
+func paletteRGB(n int) rgb {
+	switch {
+	case n < 16:
+		return basicColors[n]
+	case n < 232:
+		n -= 16
+		return rgb{cubeLevels[n/36], cubeLevels[n/6%6], cubeLevels[n%6]}
+	default:
+		v := 8 + 10*(n-232)
+		return rgb{v, v, v}
+	}
+}
+
+// closestIndex returns the index of the color closest to c out of the color
+// cube and the grayscale ramp of the 256-color palette, which, unlike the
+// basic colors, are the same across terminals.
+func closestIndex(c rgb) int {
+	var cube [3]int
+	for i, v := range c {
+		cube[i] = closestColor(rgb{v}, []rgb{{0}, {95}, {135}, {175}, {215}, {255}})
+	}
+	ci := 16 + 36*cube[0] + 6*cube[1] + cube[2]
+	gray := (c[0] + c[1] + c[2]) / 3
+	gi := 232
+	if gray > 8 {
+		gi += (gray - 8) / 10
+	}
+	if gi > 255 {
+		gi = 255
+	}
+	if colorDistance(c, paletteRGB(gi)) < colorDistance(c, paletteRGB(ci)) {
+		return gi
+	}
+	return ci
+}
+
+// closestColor returns the index of the color in cs closest to c.
+func closestColor(c rgb, cs []rgb) int {
+	best, min := 0, math.MaxInt32
+	for i, cc := range cs {
+		if d := colorDistance(c, cc); d < min {
+			best, min = i, d
+		}
+	}
+	return best
+}
+
+func colorDistance(a, b rgb) int {
+	var d int
+	for i := range a {
+		d += (a[i] - b[i]) * (a[i] - b[i])
+	}
+	return d
+}
+
+// colorDepth reports how many colors are available, as set via the _COLORS
+// environment variable, or 0 if unset.
+func colorDepth() int {
+	switch strings.ToLower(os.Getenv(colorsEnvVar)) {
+	case "16":
+		return 16
+	case "256":
+		return 256
+	case "truecolor", "24bit":
+		return 1 << 24
+	case "auto":
+		return terminalColorDepth()
+	}
+	return 0
+}
+
+var colorsEnvVar = fmt.Sprintf("%s_COLORS", strings.ToUpper(app))
+
+// terminalColorDepth reports how many colors the terminal supports, going by
+// the COLORTERM and TERM environment variables.
+func terminalColorDepth() int {
+	switch strings.ToLower(os.Getenv("COLORTERM")) {
+	case "truecolor", "24bit":
+		return 1 << 24
+	}
+	if strings.Contains(os.Getenv("TERM"), "256color") {
+		return 256
+	}
+	return 16
+}
+
+// hashColor picks a color of the given kind ("fg" or "bg") from a hash of s,
+// out of as many colors as are available, or as the terminal supports if
+// unset. Dark colors are avoided, as is red where possible, since it marks
+// standard error by default.
+func hashColor(kind, s string) ansiCode {
+	h := fnv.New32a()
+	io.WriteString(h, s)
+	n := h.Sum32()
+
+	depth := colorDepth()
+	if depth == 0 {
+		depth = terminalColorDepth()
+	}
+	switch {
+	case depth > 256:
+		r, g, b := hslToRGB(float64(30+n%300), 0.65, 0.6)
+		return rgbColor(kind, rgb{int(r), int(g), int(b)}, depth)
+	case depth == 256:
+		// Use the lighter two thirds of the 6x6x6 color cube.
+		r, g, b := 2+n%4, 2+n/4%4, 2+n/16%4
+		return indexColor(kind, int(16+36*r+6*g+b), depth)
+	default:
+		return codes[kind][sessionColors[n%uint32(len(sessionColors))]]
+	}
+}
+
+// hslToRGB converts a color from HSL, where h is in degrees and s and l are
+// fractions, to RGB.
+func hslToRGB(h, s, l float64) (r, g, b uint8) {
+	c := (1 - math.Abs(2*l-1)) * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	m := l - c/2
+	var rf, gf, bf float64
+	switch {
+	case h < 60:
+		rf, gf, bf = c, x, 0
+	case h < 120:
+		rf, gf, bf = x, c, 0
+	case h < 180:
+		rf, gf, bf = 0, c, x
+	case h < 240:
+		rf, gf, bf = 0, x, c
+	case h < 300:
+		rf, gf, bf = x, 0, c
+	default:
+		rf, gf, bf = c, 0, x
+	}
+	return uint8(math.Round((rf + m) * 255)), uint8(math.Round((gf + m) * 255)), uint8(math.Round((bf + m) * 255))
+}
+
 type ansiCode string
 
+// reReset matches the generic ANSI reset code, with or without the 0.
+var reReset = regexp.MustCompile("\033\\[0*m")
+
 // wrap wraps s with ANSI code c on the left, and the reset ANSI code on the
-// right.
-//
-// TODO: using generic [0m/[m resets does not work as intended when attributes
-// are nested, e.g., {fg red "hello" {bold "world"} "this is reset by bold"}.
-// However, attribute-specific resets are not always implemented by terminal
-// emulators.
+// right. Since attribute-specific resets are not always implemented by
+// terminal emulators, c is instead emitted again after each reset within s,
+// such that nested codes behave like a stack, e.g., in
+// {fg red "hello" {bold "world"} "still red"}.
 func (c ansiCode) wrap(s string) string {
-	return fmt.Sprintf("%s%s\033[m", c, s)
+	var (
+		sb   strings.Builder
+		prev int
+	)
+	sb.WriteString(c.String())
+	for _, loc := range reReset.FindAllStringIndex(s, -1) {
+		sb.WriteString(s[prev:loc[1]])
+		if prev = loc[1]; prev < len(s) {
+			sb.WriteString(c.String())
+		}
+	}
+	sb.WriteString(s[prev:])
+	sb.WriteString("\033[m")
+	return sb.String()
 }
 
 func (c ansiCode) wrapper() func(string) string {
@@ -3,10 +3,15 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"os"
 	"reflect"
+	"regexp"
+	"regexp/syntax"
 	"strconv"
 	"strings"
 	"testing"
+
+	"github.com/buildkite/shellwords"
 )
 
 func TestTemplateParse(t *testing.T) {
@@ -103,6 +108,11 @@ func TestTemplateParse(t *testing.T) {
 			T("  {text{", 7, errExpectedSpace),
 			T(" {text} { a", 10, errNoSuchPlaceholder),
 			T(" {text} {text", 9, errUnterminatedPlaceholder),
+			T("{match (a}", 7, &syntax.Error{Code: syntax.ErrMissingParen, Expr: "(a"}),
+			T("{match  'a)' 1}", 8, &syntax.Error{Code: syntax.ErrUnexpectedParen, Expr: "a)"}),
+			T("{replace '(a' '{bold x}'}", 9, &syntax.Error{Code: syntax.ErrMissingParen, Expr: "(a"}),
+			T("{if a =~ (a b}", 4, &syntax.Error{Code: syntax.ErrMissingParen, Expr: "(a"}),
+			T("{if ! '{text}' !~ '(a' b}", 4, &syntax.Error{Code: syntax.ErrMissingParen, Expr: "(a"}),
 		} {
 			t.Run(strconv.Itoa(i), func(t *testing.T) {
 				_, err := newTemplate("test", tc.in, defaultPlaceholders())
@@ -119,7 +129,15 @@ func TestTemplateParse(t *testing.T) {
 
 func TestTemplateRender(t *testing.T) {
 	newPs := func(ps placeholders) (res placeholders) {
+		var parsed int
 		res = placeholders{
+			"parsed": linePlaceholder(func(l *line, args []string) (string, error) {
+				v, err := l.parse("parsed", func(text string) (interface{}, error) {
+					parsed++
+					return fmt.Sprintf("%s%d", text, parsed), nil
+				})
+				return v.(string), err
+			}),
 			"echo": placeholderFunc(func(args []string) (string, error) {
 				return strings.Join(args, " "), nil
 			}),
@@ -167,6 +185,14 @@ func TestTemplateRender(t *testing.T) {
 				"C", "aA 20 20 20\naB 21 21 21\naC 22 22 22",
 			},
 		},
+		{
+			name: "line parsed once per render cycle",
+			tmpl: "{parsed} {echo {parsed}}",
+			io: []string{
+				"A", "A1 A1",
+				"B", "A1 A1\nB2 B2",
+			},
+		},
 		{
 			name: "placeholder outputs quotes",
 			tmpl: `{echo x{echo A{sgl}C} {echo A{dbl}C}}`,
@@ -195,6 +221,13 @@ func TestTemplateRender(t *testing.T) {
 				"\n", ``,
 			},
 		},
+		{
+			name: "placeholder treats arguments as shell words (drops escaping backslashes)",
+			tmpl: `{upcase a\nb} {upcase '{text}'}`,
+			io: []string{
+				`a\\b`, `ANB A\B`,
+			},
+		},
 		{
 			name: "placeholder treats arguments as shell words (keeps quoted whitespace)",
 			tmpl: `{echo '  '}`,
@@ -209,13 +242,117 @@ func TestTemplateRender(t *testing.T) {
 				"\n", `  X  `,
 			},
 		},
+		{
+			name: "conditions",
+			tmpl: `{if '{text}' =~ ERR '<{text}>' '{text}'} {if '{text}' !~ ERR yes no} {if {stream} == test t} {if ! {stream} != test t}`,
+			io: []string{
+				"an ERROR", "<an ERROR> no t t",
+				"info", "<an ERROR> no t t\ninfo yes t t",
+			},
+		},
+		{
+			name: "conditions treat placeholders without a value as empty",
+			tmpl: `{if '{pid}' '[{pid}]' none} {if '{echo x}' '[{echo x}]'}`,
+			io: []string{
+				"\n", "none [x]",
+			},
+		},
+		{
+			name: "conditions treat placeholders set without a value as empty",
+			tmpl: `{if '{pid}' '[{pid}]' none}`,
+			io: []string{
+				"\n", "none",
+			},
+			placeholders: placeholders{
+				"pid": placeholderFunc(func([]string) (string, error) { return "", errNoValue }),
+			},
+		},
+		{
+			name: "conditions render their operands once",
+			tmpl: `{if '{n}' '[{n}]'}|{n}`,
+			io: []string{
+				"\n", "[2]|3",
+			},
+			placeholders: func() placeholders {
+				var n int
+				return placeholders{
+					"n": placeholderFunc(func([]string) (string, error) {
+						n++
+						return strconv.Itoa(n), nil
+					}),
+				}
+			}(),
+		},
+		{
+			name: "conditions treat nested placeholders without a value as empty",
+			tmpl: `{if '{upcase {pid}}' yes no}|{if '{upcase x{pid}}' yes no}`,
+			io: []string{
+				"\n", "no|no",
+			},
+		},
+		{
+			name: "conditions fail if their operands fail",
+			tmpl: `{if '{cmd}' yes no}|{if '{upcase {fg}}' yes no}|{if '{pid}' '{cmd}' no}`,
+			io: []string{
+				"\n", "{if: {cmd}: <command> not specified}|{if: {upcase}: <arguments...> not specified}|{if: {cmd}: <command> not specified}",
+			},
+		},
+		{
+			name: "bad conditions",
+			tmpl: `{if a == b} {if} {if a =~ '{echo (}' b}`,
+			io: []string{
+				"\n", "{if: expected <then> [<else>] after the condition} {if: <condition> not specified, and 1 more error} {if: error parsing regexp: missing closing ): `(`}",
+			},
+		},
+		{
+			name: "conditions keep empty operands",
+			tmpl: `{if '{text}' == '' empty set} {if '{text}' =~ ERROR '<{text}>' '{text}'}|{if '{pid}' yes}|{if '' != '{echo}' yes no}`,
+			io: []string{
+				"", "empty ||no",
+				"an ERROR", "empty ||no\nset <an ERROR>||no",
+			},
+		},
+		{
+			name: "match",
+			tmpl: `{match 'id=(\d+)' 1}|{match 'id=(\\d+)' 1}|{match '(?P<k>\\w+)=' k}|{match '[a-z]+'}|{match x 0 '{echo a x b}'}|{match z}|{match x 2}`,
+			io: []string{
+				"key=val id=42", "42|42|key|key|x||{match: no such group: 2}",
+			},
+		},
+		{
+			name: "replace",
+			tmpl: `{replace '(\\d+)' '<$1>'}|{replace '\\s+' _ '{text}'}|{replace '{echo [ab]}' '{echo $0$0}'}`,
+			io: []string{
+				"a 1  b 22", "a <1>  b <22>|a_1_b_22|aa 1  bb 22",
+			},
+		},
+		{
+			name: "nested attributes are restored after inner resets",
+			tmpl: `{fg red a {bold b} c}`,
+			io: []string{
+				"\n", "\033[31ma \033[1mb\033[m\033[31m c\033[m",
+			},
+		},
+		{
+			name: "deeply nested attributes are restored after inner resets",
+			tmpl: `{fg red {bg blue {bold x} y} z}`,
+			io: []string{
+				"\n", "\033[31m\033[44m\033[1mx\033[m\033[31m\033[44m y\033[m\033[31m z\033[m",
+			},
+		},
+		{
+			name: "resets in the text restore outer attributes",
+			tmpl: `{fg red {text}!}`,
+			io: []string{
+				"a\033[0mb", "\033[31ma\033[0m\033[31mb!\033[m",
+			},
+		},
 	} {
 		t.Run(tc.name, func(t *testing.T) {
-			ps := tc.placeholders
-			if ps == nil {
-				ps = defaultPlaceholders()
+			ps := newPs(defaultPlaceholders())
+			for name, p := range tc.placeholders {
+				ps[name] = p
 			}
-			ps = newPs(ps)
 			tmpl, err := newTemplate("test", tc.tmpl, ps)
 			if err != nil {
 				t.Fatal(err)
@@ -239,6 +376,52 @@ func TestTemplateRender(t *testing.T) {
 	}
 }
 
+func TestTemplateRenderStrict(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl, out, err string
+	}{
+		{`log-{upcase x}`, "log-X", ""},
+		{`log-{pid}`, "", "{pid} has no value"},
+		{`log-{upcase {pid}}`, "", "{pid} has no value"},
+		{`log-{fg nope x}`, "", "{fg}: no such color: nope"},
+	} {
+		tmpl, err := newTemplate("test", tc.tmpl, defaultPlaceholders())
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := tmpl.renderStrict("")
+		var msg string
+		if err != nil {
+			msg = err.Error()
+		}
+		if tc.out != out || tc.err != msg {
+			t.Errorf("\n%s: -%q, %q\n+%q, %q", tc.tmpl, tc.out, tc.err, out, msg)
+		}
+		// Strictness does not outlive the render.
+		if out, _ := tmpl.renderString(""); tc.err != "" && !strings.Contains(out, "{") {
+			t.Errorf("\n%s: %q", tc.tmpl, out)
+		}
+	}
+}
+
+func TestTemplateRenderPath(t *testing.T) {
+	tmpl, err := newTemplate("test", `logs/{replace x a/b x}-{upcase {replace x c/d x}}.log`, defaultPlaceholders())
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := tmpl.renderPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exp := "logs/a-b-C-D.log"; exp != out {
+		t.Errorf("\n-%q\n+%q", exp, out)
+	}
+	// Escaping does not outlive the render.
+	if out, _ := tmpl.renderString(""); out != "logs/a/b-C/D.log" {
+		t.Errorf("\n%q", out)
+	}
+}
+
 func TestUsageParser(t *testing.T) {
 	t.Run("valid", func(t *testing.T) {
 		for _, tc := range []struct {
@@ -619,3 +802,199 @@ func TestUsageArgsCheck(t *testing.T) {
 		})
 	}
 }
+
+func TestTemplateRegexps(t *testing.T) {
+	for _, tc := range []struct {
+		tmpl    string
+		regexps []string
+	}{
+		{`{match a+ 0}`, []string{"a+"}},
+		{`{match 'id=(\d+)' 1}`, []string{`id=(\d+)`}},
+		{`{replace '(b)' '{bold $1}'}`, []string{"(b)"}},
+		{`{if '{text}' =~ ERR yes}`, []string{"ERR"}},
+		{`{if ! a !~ b+ yes}`, []string{"b+"}},
+		{`{if '{text}' =~ 'x{upcase y}' yes}`, nil},
+		{`{if a == b yes}`, nil},
+	} {
+		tmpl, err := newTemplate("test", tc.tmpl, defaultPlaceholders())
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for expr := range tmpl.regexps {
+			got = append(got, expr)
+		}
+		if !reflect.DeepEqual(tc.regexps, got) {
+			t.Errorf("\n%s: -%q +%q", tc.tmpl, tc.regexps, got)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	ps := defaultPlaceholders()
+	for _, tc := range []struct {
+		in  string
+		exp []string // as split for {if}, if different
+	}{
+		{in: `a b  c`},
+		{in: ` 'a b' "c d" `},
+		{in: `a\ b 'c\'d' "e\"f"`},
+		{in: `'a'b"c" \\`},
+		{in: `a\nb '\\d' \d`},
+		{in: `'' a "" b`, exp: []string{"", "a", "", "b"}},
+		{in: `'a`},
+	} {
+		posix, perr := shellwords.SplitPosix(tc.in)
+		for _, name := range []string{"text", "if"} {
+			exp := posix
+			if name == "if" && tc.exp != nil {
+				exp = tc.exp
+			}
+			got, err := ps.splitArgs(name, tc.in)
+			if (err != nil) != (perr != nil) {
+				t.Errorf("\n{%s %s}: error: -%v +%v", name, tc.in, perr, err)
+			} else if err == nil && !reflect.DeepEqual(exp, got) {
+				t.Errorf("\n{%s %s}: -%q +%q", name, tc.in, exp, got)
+			}
+		}
+	}
+
+	// Regexp operands keep their backslashes, unless they escape quotes or
+	// other backslashes.
+	for _, tc := range []struct {
+		name, in string
+		exp      []string
+	}{
+		{"match", `'id=(\d+)' 1 \d`, []string{`id=(\d+)`, "1", "d"}},
+		{"match", `'\\d\'' \\d`, []string{`\d'`, `\d`}},
+		{"replace", `\s+ '\t'`, []string{`\s+`, "t"}},
+		{"if", `'\d' =~ '^\d+ ' yes`, []string{"d", "=~", `^\d+ `, "yes"}},
+		{"if", `! a\d !~ \d\  yes`, []string{"!", "ad", "!~", `\d `, "yes"}},
+		{"if", `a == \d yes`, []string{"a", "==", "d", "yes"}},
+	} {
+		got, err := ps.splitArgs(tc.name, tc.in)
+		if err != nil {
+			t.Errorf("\n{%s %s}: %s", tc.name, tc.in, err)
+		} else if !reflect.DeepEqual(tc.exp, got) {
+			t.Errorf("\n{%s %s}: -%q +%q", tc.name, tc.in, tc.exp, got)
+		}
+	}
+}
+
+func TestHashColor(t *testing.T) {
+	for _, tc := range []struct {
+		colorterm, term string
+		kind            string
+		re              string
+	}{
+		{"truecolor", "xterm", "fg", `^38;2;\d+;\d+;\d+$`},
+		{"24bit", "xterm", "bg", `^48;2;\d+;\d+;\d+$`},
+		{"", "xterm-256color", "fg", `^38;5;\d+$`},
+		{"", "xterm-256color", "bg", `^48;5;\d+$`},
+		{"", "xterm", "fg", `^(3[2-6]|9[2-6])$`},
+		{"", "xterm", "bg", `^(4[2-6]|10[2-6])$`},
+	} {
+		func() {
+			defer setenv(colorsEnvVar, "")()
+			defer setenv("COLORTERM", tc.colorterm)()
+			defer setenv("TERM", tc.term)()
+			re := regexp.MustCompile(tc.re)
+			for _, s := range []string{"web", "worker", "db", ""} {
+				c := hashColor(tc.kind, s)
+				if !re.MatchString(string(c)) {
+					t.Errorf("%s/%s: %q: %q does not match %s", tc.colorterm, tc.term, s, c, tc.re)
+				}
+				if again := hashColor(tc.kind, s); c != again {
+					t.Errorf("%s/%s: %q: unstable: %q != %q", tc.colorterm, tc.term, s, c, again)
+				}
+			}
+		}()
+	}
+}
+
+func TestParseColor(t *testing.T) {
+	for _, tc := range []struct {
+		depth int
+		kind  string
+		id    string
+		code  ansiCode
+		err   bool
+	}{
+		{16, "fg", "red", "31", false},
+		{16, "bg", "light-blue", "104", false},
+		{256, "fg", "9", "91", false},
+		{256, "fg", "208", "38;5;208", false},
+		{256, "bg", "208", "48;5;208", false},
+		{16, "fg", "208", "33", false},
+		{16, "fg", "232", "30", false},
+		{1 << 24, "fg", "#ff8800", "38;2;255;136;0", false},
+		{1 << 24, "fg", "#f80", "38;2;255;136;0", false},
+		{1 << 24, "bg", "rgb(10,20,30)", "48;2;10;20;30", false},
+		{1 << 24, "bg", "rgb(10, 20, 30)", "48;2;10;20;30", false},
+		{256, "fg", "#ff8700", "38;5;208", false},
+		{256, "fg", "#808080", "38;5;244", false},
+		{16, "fg", "#ff0000", "91", false},
+		{16, "bg", "rgb(0,0,0)", "40", false},
+		{256, "fg", "256", "", true},
+		{256, "fg", "#ff880", "", true},
+		{256, "fg", "#gg8800", "", true},
+		{256, "fg", "rgb(1,2)", "", true},
+		{256, "fg", "rgb(1,2,300)", "", true},
+		{256, "fg", "orange", "", true},
+	} {
+		var code ansiCode
+		var err error
+		switch {
+		case tc.depth > 256:
+			code, err = parseColorAt(tc.kind, tc.id, "", "", "xterm")
+		case tc.depth == 256:
+			code, err = parseColorAt(tc.kind, tc.id, "256", "", "xterm")
+		default:
+			code, err = parseColorAt(tc.kind, tc.id, "16", "", "xterm")
+		}
+		if tc.err != (err != nil) {
+			t.Errorf("%s %s (%d): unexpected error: %v", tc.kind, tc.id, tc.depth, err)
+		}
+		if tc.code != code {
+			t.Errorf("%s %s (%d): -%q +%q", tc.kind, tc.id, tc.depth, tc.code, code)
+		}
+	}
+}
+
+func TestParseColorAuto(t *testing.T) {
+	for _, tc := range []struct {
+		colorterm, term string
+		code            ansiCode
+	}{
+		{"truecolor", "xterm", "38;2;255;135;0"},
+		{"", "xterm-256color", "38;5;208"},
+		{"", "xterm", "33"},
+	} {
+		if code, _ := parseColorAt("fg", "#ff8700", "auto", tc.colorterm, tc.term); tc.code != code {
+			t.Errorf("%s/%s: -%q +%q", tc.colorterm, tc.term, tc.code, code)
+		}
+	}
+}
+
+// parseColorAt parses a color with the _COLORS, COLORTERM and TERM
+// environment variables set as given.
+func parseColorAt(kind, id, colors, colorterm, term string) (ansiCode, error) {
+	defer setenv(colorsEnvVar, colors)()
+	defer setenv("COLORTERM", colorterm)()
+	defer setenv("TERM", term)()
+	return parseColor(kind, id)
+}
+
+// setenv sets an environment variable and returns a function that restores
+// its previous value.
+func setenv(key, val string) func() {
+	old, ok := os.LookupEnv(key)
+	os.Setenv(key, val)
+	return func() {
+		if ok {
+			os.Setenv(key, old)
+		} else {
+			os.Unsetenv(key)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
 	"math"
 	"os"
 	"os/exec"
@@ -10,9 +11,16 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 	"unicode"
 )
 
+func closeAll(cs []io.Closer) {
+	for _, c := range cs {
+		c.Close()
+	}
+}
+
 func isPipe(f *os.File) bool {
 	stat, err := f.Stat()
 	return err == nil && stat.Mode()&os.ModeCharDevice == 0
@@ -73,6 +81,46 @@ func parseSize(val string) (size int64, _ error) {
 	return size, nil
 }
 
+// parseDuration is like time.ParseDuration, but also accepts days and weeks
+// (e.g., 14d, 2w).
+func parseDuration(val string) (time.Duration, error) {
+	val = strings.TrimSpace(val)
+	if n := len(val); n > 1 {
+		var unit time.Duration
+		switch val[n-1] {
+		case 'd', 'D':
+			unit = 24 * time.Hour
+		case 'w', 'W':
+			unit = 7 * 24 * time.Hour
+		}
+		if unit > 0 {
+			num, err := strconv.ParseUint(strings.TrimSpace(val[:n-1]), 10, 0)
+			if err != nil {
+				return 0, errors.New("number part must be an integer")
+			}
+			return time.Duration(num) * unit, nil
+		}
+	}
+	return time.ParseDuration(val)
+}
+
+// parseInterval parses rotation intervals, which are either one of "hourly",
+// "daily" or "weekly", or a duration accepted by parseDuration.
+func parseInterval(val string) (rotateInterval, error) {
+	switch unit := strings.ToLower(strings.TrimSpace(val)); unit {
+	case "hourly", "daily", "weekly":
+		return rotateInterval{unit: unit}, nil
+	}
+	dur, err := parseDuration(val)
+	if err != nil {
+		return rotateInterval{}, fmt.Errorf("invalid interval: %q", val)
+	}
+	if dur <= 0 {
+		return rotateInterval{}, errors.New("interval must be positive")
+	}
+	return rotateInterval{every: dur}, nil
+}
+
 var byteSizes = []string{"b", "kb", "mb", "gb", "tb", "pb", "eb"}
 
 // humanBytes is adapted from github.com/dustin/go-humanize.
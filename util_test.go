@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"testing"
+	"time"
+)
 
 func TestCountDigits(t *testing.T) {
 	for _, tc := range []struct {
@@ -145,3 +148,79 @@ func TestJustify(t *testing.T) {
 		}
 	}
 }
+
+func TestParseDuration(t *testing.T) {
+	for _, tc := range []struct {
+		in  string
+		out time.Duration
+	}{
+		{"1s", time.Second},
+		{"90m", 90 * time.Minute},
+		{"1d", 24 * time.Hour},
+		{" 14d ", 14 * 24 * time.Hour},
+		{"2w", 14 * 24 * time.Hour},
+	} {
+		exp := tc.out
+		got, err := parseDuration(tc.in)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if exp != got {
+			t.Errorf("\nparseDuration(%q) => -%s +%s", tc.in, exp, got)
+		}
+	}
+}
+
+func TestRotateInterval(t *testing.T) {
+	loc := time.UTC
+	at := time.Date(2021, 2, 17, 13, 45, 10, 0, loc) // a Wednesday
+	for _, tc := range []struct {
+		in  string
+		out time.Time
+	}{
+		{"hourly", time.Date(2021, 2, 17, 14, 0, 0, 0, loc)},
+		{"daily", time.Date(2021, 2, 18, 0, 0, 0, 0, loc)},
+		{"Weekly", time.Date(2021, 2, 22, 0, 0, 0, 0, loc)},
+		{"30m", time.Date(2021, 2, 17, 14, 0, 0, 0, loc)},
+		{"1s", time.Date(2021, 2, 17, 13, 45, 11, 0, loc)},
+		{"5h", time.Date(2021, 2, 17, 15, 0, 0, 0, loc)},
+		{"2d", time.Date(2021, 2, 18, 0, 0, 0, 0, loc)},
+	} {
+		i, err := parseInterval(tc.in)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if exp, got := tc.out, i.next(at); !exp.Equal(got) {
+			t.Errorf("\nparseInterval(%q).next(%s) => -%s +%s", tc.in, at, exp, got)
+		}
+	}
+
+	// Intervals are aligned to local midnight, rather than UTC's.
+	loc = time.FixedZone("UTC+5:30", 5*3600+30*60)
+	for _, tc := range []struct {
+		in      string
+		at, out time.Time
+	}{
+		{"12h", time.Date(2021, 2, 17, 13, 45, 10, 0, loc), time.Date(2021, 2, 18, 0, 0, 0, 0, loc)},
+		{"5h", time.Date(2021, 2, 17, 21, 0, 0, 0, loc), time.Date(2021, 2, 18, 0, 0, 0, 0, loc)},
+		{"45m", time.Date(2021, 2, 17, 1, 0, 0, 0, loc), time.Date(2021, 2, 17, 1, 30, 0, 0, loc)},
+		{"2d", time.Date(2021, 2, 17, 23, 59, 0, 0, loc), time.Date(2021, 2, 18, 0, 0, 0, 0, loc)},
+		{"2d", time.Date(2021, 2, 18, 0, 0, 0, 0, loc), time.Date(2021, 2, 20, 0, 0, 0, 0, loc)},
+	} {
+		i, err := parseInterval(tc.in)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if exp, got := tc.out, i.next(tc.at); !exp.Equal(got) {
+			t.Errorf("\nparseInterval(%q).next(%s) => -%s +%s", tc.in, tc.at, exp, got)
+		}
+	}
+	for _, in := range []string{"", "0s", "-1h", "monthly"} {
+		if _, err := parseInterval(in); err == nil {
+			t.Errorf("\nparseInterval(%q): expected error", in)
+		}
+	}
+}
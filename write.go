@@ -2,13 +2,22 @@ package main
 
 import (
 	"bytes"
+	"compress/gzip"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
 	"unicode/utf8"
 
 	"github.com/pborman/ansi"
@@ -156,11 +165,24 @@ func (w *quoteEscaper) Write(p []byte) (int, error) {
 	return n, err
 }
 
+// pathEscaper replaces path separators with dashes.
+type pathEscaper struct {
+	io.Writer
+}
+
+func (w *pathEscaper) Write(p []byte) (int, error) {
+	return w.Writer.Write(bytes.Map(func(r rune) rune {
+		if r == '/' || r == filepath.Separator {
+			return '-'
+		}
+		return r
+	}, p))
+}
+
 // newInterlockedWriterPair creates a pair of Writers whose Write method is
-// protected by the same mutex, such that neither one of them can mangle the
-// output of the other.
-func newInterlockedWriterPair(a, b io.Writer) (io.Writer, io.Writer) {
-	mu := new(sync.Mutex)
+// protected by mu, such that neither one of them, nor any other pair sharing
+// mu, can mangle the output of the other.
+func newInterlockedWriterPair(mu *sync.Mutex, a, b io.Writer) (io.Writer, io.Writer) {
 	a = &interlockedWriter{Mutex: mu, Writer: a}
 	b = &interlockedWriter{Mutex: mu, Writer: b}
 	return a, b
@@ -177,55 +199,237 @@ func (w *interlockedWriter) Write(p []byte) (int, error) {
 	return w.Writer.Write(p)
 }
 
-// byteCounter counts how many bytes it writes.
+// byteCounter counts how many bytes, and optionally lines, it writes.
 type byteCounter struct {
 	io.Writer
-	n *uint64
+	n     *uint64
+	lines *uint64
 }
 
 func (w *byteCounter) Write(p []byte) (int, error) {
 	n, err := w.Writer.Write(p)
 	*w.n += uint64(n)
+	if w.lines != nil {
+		*w.lines += uint64(bytes.Count(p[:n], []byte{'\n'}))
+	}
 	return n, err
 }
 
-func newFileRotator(path string, maxSize int64, maxCount int) (*fileRotator, error) {
+const formatText = "text" // logfiles take after the terminal output
+
+// recordFormats encode records for structured logfiles, one per line.
+var recordFormats = map[string]func(*record) ([]byte, error){
+	"json": func(r *record) ([]byte, error) {
+		b, err := json.Marshal(r)
+		return append(b, '\n'), err
+	},
+	"logfmt": func(r *record) ([]byte, error) {
+		var buf bytes.Buffer
+		kv := func(k, v string) {
+			if buf.Len() > 0 {
+				buf.WriteByte(' ')
+			}
+			buf.WriteString(k)
+			buf.WriteByte('=')
+			buf.WriteString(logfmtValue(v))
+		}
+		kv("ts", r.Time.Format(time.RFC3339Nano))
+		kv("stream", r.Stream)
+		kv("name", r.Name)
+		if r.PID != 0 {
+			kv("pid", strconv.Itoa(r.PID))
+		}
+		kv("seq", strconv.FormatUint(r.Seq, 10))
+		kv("msg", r.Msg)
+		buf.WriteByte('\n')
+		return buf.Bytes(), nil
+	},
+}
+
+// logfmtValue quotes v if it is empty or contains spaces, quotes, equal
+// signs or non-printable characters.
+func logfmtValue(v string) string {
+	if v == "" || strings.IndexFunc(v, func(r rune) bool {
+		return r <= ' ' || r == '=' || r == '"' || r == '\\' || !unicode.IsPrint(r)
+	}) != -1 {
+		return strconv.Quote(v)
+	}
+	return v
+}
+
+// record is an entry of a structured logfile.
+type record struct {
+	Time   time.Time `json:"ts"`
+	Stream string    `json:"stream"`
+	Name   string    `json:"name"`
+	PID    int       `json:"pid,omitempty"`
+	Seq    uint64    `json:"seq"`
+	Msg    string    `json:"msg"`
+}
+
+// recorder encodes records on behalf of a session.
+type recorder struct {
+	seq    uint64 // accessed atomically; keep 64-bit aligned
+	pid    int64  // same as above; set once the command is started
+	format string
+	name   string
+}
+
+func (r *recorder) setPid(pid int) {
+	atomic.StoreInt64(&r.pid, int64(pid))
+}
+
+func (r *recorder) encode(stream, msg string) ([]byte, error) {
+	return recordFormats[r.format](&record{
+		Time:   time.Now(),
+		Stream: stream,
+		Name:   r.name,
+		PID:    int(atomic.LoadInt64(&r.pid)),
+		Seq:    atomic.AddUint64(&r.seq, 1),
+		Msg:    msg,
+	})
+}
+
+// recordWriter writes each line out as a record of the given stream, with
+// ANSI escape sequences stripped.
+type recordWriter struct {
+	io.Writer
+	*recorder
+	stream string
+}
+
+func (w *recordWriter) Write(p []byte) (n int, err error) {
+	n = len(p)
+	msg, err := ansi.Strip(bytes.TrimSuffix(p, []byte{'\n'}))
+	if err != nil {
+		return 0, err
+	}
+	b, err := w.encode(w.stream, string(msg))
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.Writer.Write(b); err != nil {
+		return 0, err
+	}
+	return
+}
+
+func (w *recordWriter) Close() error {
+	if c, ok := w.Writer.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// rotateOpts controls when logfiles are turned over and how many are kept.
+type rotateOpts struct {
+	maxSize  int64
+	maxCount int
+	every    rotateInterval
+	compress string // compression method for rotated logfiles, if any
+	suffix   string // suffixIndex or suffixDate
+	maxAge   time.Duration
+	maxTotal int64 // total size of rotated logfiles
+}
+
+// retaining reports whether rotated logfiles are kept at all, as opposed to
+// truncating the logfile on rotation.
+func (o rotateOpts) retaining() bool {
+	return o.maxCount > 0 || o.maxAge > 0 || o.maxTotal > 0
+}
+
+const (
+	suffixIndex = "index" // <file>.0, <file>.1, ...; shifted on each rotation
+	suffixDate  = "date"  // <file>.<rotation timestamp>; never renamed
+
+	suffixDateFormat = "2006-01-02T15-04-05"
+)
+
+func newFileRotator(path string, opts rotateOpts) (*fileRotator, error) {
 	f, err := openLogfile(path)
 	if err != nil {
 		return nil, err
 	}
+	r := &fileRotator{rotateOpts: opts}
+	if err := r.setFile(f); err != nil {
+		return nil, err
+	}
 
-	r := &fileRotator{
-		file:     f,
-		maxSize:  maxSize,
-		maxCount: maxCount,
-		fileRe:   regexp.MustCompile(fmt.Sprintf(`%s\.\d+`, regexp.QuoteMeta(f.Name()))),
+	// Pick up where a previous session left off, such that a logfile last
+	// written to before the current interval is turned over on first write.
+	since := time.Now()
+	if stat, err := f.Stat(); err == nil && stat.Size() > 0 {
+		since = stat.ModTime()
 	}
+	r.schedule(since)
+	return r, nil
+}
 
-	// Ensure we have an ordered list of files.
-	if err := r.reorder(0); err != nil {
-		return nil, err
+// setFile makes f the current logfile, and puts the old logfiles that
+// belong to it in order.
+func (w *fileRotator) setFile(f *logfile) error {
+	// Dated suffixes may carry a counter in case of multiple rotations
+	// within the same second.
+	suffixRe := `\d+`
+	if w.suffix == suffixDate {
+		suffixRe = `\d{4}-\d\d-\d\dT\d\d-\d\d-\d\d(?:-\d+)?`
+	}
+	w.file = f
+	w.fileRe = regexp.MustCompile(fmt.Sprintf(
+		`^%s\.(%s)(%s)?$`,
+		regexp.QuoteMeta(filepath.Base(f.Name())),
+		suffixRe,
+		strings.Join(strs(compressExts()).transform(regexp.QuoteMeta), "|"),
+	))
+	if err := w.removeStale(); err != nil {
+		return err
+	}
+
+	// Ensure we have an ordered list of files. Dated files are never
+	// renamed, so just count them.
+	if w.suffix == suffixDate {
+		w.fileCount = len(w.files())
+	} else if err := w.reorder(0); err != nil {
+		return err
 	}
 
 	// If we're limited to a number of logfiles, drop whatever falls outside
 	// the range.
-	if maxCount > 0 {
-		if err := r.slice(maxCount); err != nil {
-			return nil, err
+	if w.maxCount > 0 {
+		if err := w.slice(w.maxCount); err != nil {
+			return err
 		}
 	}
-	return r, nil
+	return w.prune()
 }
 
 type fileRotator struct {
-	file      *os.File
-	maxSize   int64
-	maxCount  int
+	file *logfile
+	rotateOpts
 	fileRe    *regexp.Regexp
-	fileCount int // current file count
+	fileCount int       // current file count
+	due       time.Time // next time-based rotation, if any
+
+	// render, if set, renders the logfile path anew on each rotation. If the
+	// path changes, logging moves on to the new path instead.
+	render func() (string, error)
+
+	// onRotate, if set, is called with the new logfile after each rotation.
+	onRotate func(io.Writer) error
+
+	// Rotated logfiles are compressed in the background; pending tracks
+	// compression jobs, which are waited for before the file list is
+	// touched again.
+	pending    sync.WaitGroup
+	mu         sync.Mutex // guards the fields below, set by compression jobs
+	compressed bool       // set once a job is done, such that the file list is pruned
+	asyncErr   error
 }
 
 func (w *fileRotator) spaceLeft() (n int64) {
+	if w.maxSize == 0 {
+		return math.MaxInt64
+	}
 	stat, err := w.file.Stat()
 	if err != nil {
 		return
@@ -237,13 +441,36 @@ func (w *fileRotator) spaceLeft() (n int64) {
 	return
 }
 
+// schedule sets the time of the next time-based rotation relative to t.
+func (w *fileRotator) schedule(t time.Time) {
+	if !w.every.isZero() {
+		w.due = w.every.next(t)
+	}
+}
+
+// expired reports whether a time-based rotation is due. Empty logfiles are
+// never turned over; their rotation is rescheduled instead.
+func (w *fileRotator) expired() bool {
+	if w.due.IsZero() || time.Now().Before(w.due) {
+		return false
+	}
+	if stat, err := w.file.Stat(); err == nil && stat.Size() == 0 {
+		w.schedule(time.Now())
+		return false
+	}
+	return true
+}
+
 func (w *fileRotator) Write(p []byte) (n int, err error) {
 	defer func() {
 		if err != nil {
 			err = w.err(err)
 		}
 	}()
-	if int64(len(p)) > w.spaceLeft() {
+	if err = w.collect(); err != nil {
+		return
+	}
+	if w.expired() || int64(len(p)) > w.spaceLeft() {
 		if err = w.rotate(); err != nil {
 			return
 		}
@@ -251,20 +478,41 @@ func (w *fileRotator) Write(p []byte) (n int, err error) {
 	return w.file.Write(p)
 }
 
+func (w *fileRotator) requestReopen() { w.file.requestReopen() }
+
 func (w *fileRotator) Close() error {
-	return w.file.Close()
+	err := w.wait()
+	if cerr := w.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (w *fileRotator) rotate() (err error) {
 	defer func() {
 		if err == nil {
-			err = notice(w.file, "logfile turned over")
+			w.schedule(time.Now())
+			if w.onRotate != nil {
+				err = w.onRotate(w.file)
+			}
 		}
 	}()
-	if w.maxCount == 0 {
+	if err := w.wait(); err != nil {
+		return err
+	}
+	if w.render != nil {
+		path, err := w.render()
+		if err != nil {
+			return err
+		}
+		if path != w.file.path {
+			return w.switchTo(path)
+		}
+	}
+	if !w.retaining() {
 		return w.truncate()
 	}
-	if w.fileCount == w.maxCount {
+	if w.maxCount > 0 && w.fileCount == w.maxCount {
 		if err := w.dropLast(); err != nil {
 			return err
 		}
@@ -273,15 +521,17 @@ func (w *fileRotator) rotate() (err error) {
 }
 
 // prependCurrent prepends <file> to the head of the file list under <file>.0
-// and recreates <file>.
+// (or <file>.<timestamp>) and recreates <file>.
 func (w *fileRotator) prependCurrent() error {
-	// Move <file>.0 to <file>.1, etc.
-	if err := w.shiftRight(); err != nil {
+	old, new := w.file.Name(), w.fileNameAt(0)
+	if w.suffix == suffixDate {
+		new = w.datedFileName(time.Now())
+	} else if err := w.shiftRight(); err != nil {
+		// Move <file>.0 to <file>.1, etc.
 		return err
 	}
 
 	// Copy <file> to <file>.0 and recreate <file>.
-	old, new := w.file.Name(), w.fileNameAt(0)
 	if err := w.file.Close(); err != nil {
 		return err
 	}
@@ -290,16 +540,65 @@ func (w *fileRotator) prependCurrent() error {
 	}
 
 	// Touch the original file.
-	f, err := openLogfile(old)
-	if err != nil {
+	if err := w.file.open(); err != nil {
 		return err
 	}
-	w.file = f
 
-	if w.fileCount < w.maxCount {
+	if w.maxCount == 0 || w.fileCount < w.maxCount {
 		w.fileCount++
 	}
-	return nil
+	if w.compress != "" {
+		w.compressLater(new)
+		return nil
+	}
+	return w.prune()
+}
+
+// switchTo closes the current logfile, leaving it in place, and carries on
+// logging to path.
+func (w *fileRotator) switchTo(path string) error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	f, err := openLogfile(path)
+	if err != nil {
+		return err
+	}
+	return w.setFile(f)
+}
+
+// compressLater compresses path in the background, replacing it with its
+// compressed counterpart once done. The file list is pruned afterwards by
+// collect, as only the writing goroutine may touch it.
+func (w *fileRotator) compressLater(path string) {
+	w.pending.Add(1)
+	go func() {
+		defer w.pending.Done()
+		err := compressFile(w.compress, path)
+		w.mu.Lock()
+		w.compressed = true
+		w.asyncErr = err
+		w.mu.Unlock()
+	}()
+}
+
+// collect prunes the file list if a compression job is done, and returns the
+// error of the last one, if any.
+func (w *fileRotator) collect() error {
+	w.mu.Lock()
+	compressed, err := w.compressed, w.asyncErr
+	w.compressed, w.asyncErr = false, nil
+	w.mu.Unlock()
+	if err == nil && compressed {
+		err = w.prune()
+	}
+	return err
+}
+
+// wait waits for pending compression jobs and collects them.
+func (w *fileRotator) wait() error {
+	w.pending.Wait()
+	return w.collect()
 }
 
 func (w *fileRotator) shiftRight() error {
@@ -325,7 +624,7 @@ func (w *fileRotator) slice(to int) error {
 
 	// Drop whatever happens to lie outside of fs[:to].
 	for _, f := range fs[to:] {
-		if err := os.Remove(f); err != nil {
+		if err := os.Remove(f.path); err != nil {
 			return err
 		}
 		w.fileCount--
@@ -333,6 +632,35 @@ func (w *fileRotator) slice(to int) error {
 	return nil
 }
 
+// prune drops the files that are older than maxAge, along with those that
+// push the total size of the file list over maxTotal.
+func (w *fileRotator) prune() error {
+	if w.maxAge == 0 && w.maxTotal == 0 {
+		return nil
+	}
+	var (
+		now   = time.Now()
+		total int64
+	)
+	for i, f := range w.files() {
+		stat, err := os.Stat(f.path)
+		if err != nil {
+			return err
+		}
+		at := f.at
+		if at.IsZero() {
+			at = stat.ModTime()
+		}
+		total += stat.Size()
+		switch {
+		case w.maxAge > 0 && now.Sub(at) > w.maxAge,
+			w.maxTotal > 0 && total > w.maxTotal:
+			return w.slice(i)
+		}
+	}
+	return nil
+}
+
 // reorder reorders files such that the first file ends with a suffix that
 // corresponds to startAt, and increments subsequent ones.
 func (w *fileRotator) reorder(startAt int) error {
@@ -341,8 +669,8 @@ func (w *fileRotator) reorder(startAt int) error {
 	// Start renaming files from the end of the list, such that each file has
 	// a slot to its "right-side" to accommodate it.
 	for i := len(fs) - 1; i >= 0; i-- {
-		old := fs[i]
-		new := w.fileNameAt(startAt + i)
+		old := fs[i].path
+		new := w.fileNameAt(startAt+i) + fs[i].ext
 		if old != new {
 			if err := os.Rename(old, new); err != nil {
 				return err
@@ -353,18 +681,78 @@ func (w *fileRotator) reorder(startAt int) error {
 	return nil
 }
 
+// rotatedFile is an old logfile of the form <file>.<suffix>[.<ext>].
+type rotatedFile struct {
+	path string
+	idx  int       // index suffix, or counter of a dated suffix
+	at   time.Time // dated suffix
+	ext  string    // compression extension, if any
+}
+
+// newer reports whether f was rotated more recently than g.
+func (f rotatedFile) newer(g rotatedFile) bool {
+	if !f.at.Equal(g.at) {
+		return f.at.After(g.at)
+	}
+	if f.at.IsZero() {
+		return f.idx < g.idx
+	}
+	return f.idx > g.idx
+}
+
 // files returns the list of old logfiles (i.e., everything but w.file), with the
 // newest file (<file>.0) at the start of the slice.
-func (w *fileRotator) files() (res []string) {
-	fs, err := ioutil.ReadDir(filepath.Dir(w.file.Name()))
+// removeStale removes the temporary files of compression jobs that were cut
+// short, e.g., by a previous session being killed.
+func (w *fileRotator) removeStale() error {
+	dir := filepath.Dir(w.file.Name())
+	fs, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, f := range fs {
+		name := strings.TrimSuffix(f.Name(), compressTmpExt)
+		if name == f.Name() || f.IsDir() {
+			continue
+		}
+		if m := w.fileRe.FindStringSubmatch(name); m != nil && m[2] != "" {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (w *fileRotator) files() (res []rotatedFile) {
+	dir := filepath.Dir(w.file.Name())
+	fs, err := ioutil.ReadDir(dir)
 	if err != nil {
 		return
 	}
 	for _, f := range fs {
-		if w.fileRe.MatchString(f.Name()) && !f.IsDir() {
-			res = append(res, f.Name())
+		m := w.fileRe.FindStringSubmatch(f.Name())
+		if m == nil || f.IsDir() {
+			continue
+		}
+		rf := rotatedFile{
+			path: filepath.Join(dir, f.Name()),
+			ext:  m[2],
+		}
+		suffix := m[1]
+		if w.suffix == suffixDate {
+			stamp := suffix[:len(suffixDateFormat)]
+			if rf.at, err = time.ParseInLocation(suffixDateFormat, stamp, time.Local); err != nil {
+				continue
+			}
+			suffix = strings.TrimPrefix(suffix[len(stamp):], "-")
 		}
+		rf.idx, _ = strconv.Atoi(suffix)
+		res = append(res, rf)
 	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].newer(res[j])
+	})
 	return
 }
 
@@ -373,6 +761,22 @@ func (w *fileRotator) fileNameAt(idx int) string {
 	return fmt.Sprintf("%s.%s", w.file.Name(), w.nthFileSuffix(idx))
 }
 
+// datedFileName generates a filename that corresponds to <file>.<timestamp>,
+// appending a counter if a file rotated at the same time already exists.
+func (w *fileRotator) datedFileName(t time.Time) string {
+	dir, base := filepath.Split(w.file.Name())
+	name := fmt.Sprintf("%s.%s", base, t.Format(suffixDateFormat))
+	taken := make(map[string]bool)
+	for _, f := range w.files() {
+		taken[filepath.Base(strings.TrimSuffix(f.path, f.ext))] = true
+	}
+	res := name
+	for n := 1; taken[res]; n++ {
+		res = fmt.Sprintf("%s-%d", name, n)
+	}
+	return filepath.Join(dir, res)
+}
+
 func (w *fileRotator) nthFileSuffix(n int) string {
 	return fmt.Sprintf("%0*d", countDigits(w.maxCount-1), n)
 }
@@ -388,11 +792,195 @@ func (w *fileRotator) errf(s string, args ...interface{}) error {
 	return fmt.Errorf("rotate: %s", fmt.Sprintf(s, args...))
 }
 
+// rotateInterval describes wall-clock boundaries at which logfiles are turned
+// over: either calendar units (hourly, daily, weekly) or a fixed duration.
+type rotateInterval struct {
+	unit  string
+	every time.Duration
+}
+
+func (i rotateInterval) isZero() bool {
+	return i.unit == "" && i.every == 0
+}
+
+// next returns the first boundary that follows t. Intervals are aligned to
+// local midnight: those shorter than a day are counted from the start of each
+// day, while longer ones are rounded to whole days, counted from the Unix
+// epoch, such that boundaries are kept across sessions.
+func (i rotateInterval) next(t time.Time) time.Time {
+	y, m, d := t.Date()
+	switch i.unit {
+	case "hourly":
+		return time.Date(y, m, d, t.Hour()+1, 0, 0, 0, t.Location())
+	case "daily":
+		return time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+	case "weekly":
+		// Weeks start on Monday.
+		days := 7 - (int(t.Weekday())+6)%7
+		return time.Date(y, m, d+days, 0, 0, 0, 0, t.Location())
+	}
+	const day = 24 * time.Hour
+	if i.every >= day {
+		days := int(i.every.Round(day) / day)
+		epochDays := int(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Unix() / int64(day/time.Second))
+		return time.Date(y, m, d+days-epochDays%days, 0, 0, 0, 0, t.Location())
+	}
+	start := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	midnight := time.Date(y, m, d+1, 0, 0, 0, 0, t.Location())
+	if next := start.Add((t.Sub(start)/i.every + 1) * i.every); next.Before(midnight) {
+		return next
+	}
+	return midnight
+}
+
+func (i rotateInterval) String() string {
+	if i.unit != "" {
+		return i.unit
+	}
+	return i.every.String()
+}
+
+var compressors = map[string]struct {
+	ext string
+	fn  func(dst io.Writer, src io.Reader) error
+}{
+	"gzip": {".gz", func(dst io.Writer, src io.Reader) error {
+		zw := gzip.NewWriter(dst)
+		if _, err := io.Copy(zw, src); err != nil {
+			return err
+		}
+		return zw.Close()
+	}},
+}
+
+// compressTmpExt is appended to compressed files while they're written.
+const compressTmpExt = ".tmp"
+
+func compressExts() (res []string) {
+	for _, c := range compressors {
+		res = append(res, c.ext)
+	}
+	sort.Strings(res)
+	return
+}
+
+// compressFile compresses path into path.<ext> using the given method, and
+// removes path once done.
+func compressFile(method, path string) error {
+	c, ok := compressors[method]
+	if !ok {
+		return fmt.Errorf("no such compression method: %s", method)
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Write to a temporary file first, such that partially compressed
+	// files are never mistaken for rotated logfiles.
+	dst := path + c.ext
+	tmp, err := os.OpenFile(dst+compressTmpExt, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, logPerms)
+	if err != nil {
+		return err
+	}
+	if err := c.fn(tmp, src); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("%s: %s", method, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), dst); err != nil {
+		return err
+	}
+	src.Close()
+	return os.Remove(path)
+}
+
 const (
-	logMode  = os.O_CREATE | os.O_WRONLY | os.O_APPEND
-	logPerms = 0644
+	logMode     = os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	logPerms    = 0644
+	logDirPerms = 0755
 )
 
-func openLogfile(path string) (*os.File, error) {
-	return os.OpenFile(path, logMode, logPerms)
+func openLogfile(path string) (*logfile, error) {
+	f := &logfile{path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// logfileCheckInterval limits how often a logfile checks whether its path
+// still points to it.
+var logfileCheckInterval = time.Second
+
+// logfile is a file that is reopened under its original path when requested
+// (e.g., on SIGHUP) or when it is moved or deleted by an external tool, such
+// as logrotate.
+type logfile struct {
+	file      *os.File
+	path      string
+	reopening int32 // set asynchronously; handled on the next write
+	checkedAt time.Time
+}
+
+func (f *logfile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.path), logDirPerms); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, logMode, logPerms)
+	if err != nil {
+		return err
+	}
+	f.file = file
+	f.checkedAt = time.Now()
+	return nil
+}
+
+func (f *logfile) reopen() error {
+	f.file.Close()
+	return f.open()
 }
+
+// requestReopen makes the next write reopen the file. It is safe to call
+// concurrently with Write.
+func (f *logfile) requestReopen() {
+	atomic.StoreInt32(&f.reopening, 1)
+}
+
+// stale reports whether the file needs to be reopened.
+func (f *logfile) stale() bool {
+	if atomic.CompareAndSwapInt32(&f.reopening, 1, 0) {
+		return true
+	}
+	if time.Since(f.checkedAt) < logfileCheckInterval {
+		return false
+	}
+	f.checkedAt = time.Now()
+	stat, err := os.Stat(f.path)
+	if os.IsNotExist(err) {
+		return true
+	}
+	if err != nil {
+		return false
+	}
+	fstat, err := f.file.Stat()
+	return err == nil && !os.SameFile(stat, fstat)
+}
+
+func (f *logfile) Write(p []byte) (int, error) {
+	if f.stale() {
+		if err := f.reopen(); err != nil {
+			return 0, err
+		}
+	}
+	return f.file.Write(p)
+}
+
+func (f *logfile) Name() string               { return f.file.Name() }
+func (f *logfile) Stat() (os.FileInfo, error) { return f.file.Stat() }
+func (f *logfile) Truncate(size int64) error  { return f.file.Truncate(size) }
+func (f *logfile) Close() error               { return f.file.Close() }
@@ -4,9 +4,13 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestLineWriter(t *testing.T) {
@@ -167,6 +171,271 @@ func TestQuoteEscaper(t *testing.T) {
 	}
 }
 
+func TestRecordWriter(t *testing.T) {
+	for _, tc := range []struct {
+		format string
+		ts     *regexp.Regexp
+		exp    string
+	}{
+		{
+			"json",
+			regexp.MustCompile(`"ts":"[^"]+"`),
+			`{"ts":"","stream":"stderr","name":"test","pid":42,"seq":1,"msg":"a \"red\" line"}` + "\n" +
+				`{"ts":"","stream":"stderr","name":"test","pid":42,"seq":2,"msg":""}` + "\n",
+		},
+		{
+			"logfmt",
+			regexp.MustCompile(`ts=\S+`),
+			`ts="" stream=stderr name=test pid=42 seq=1 msg="a \"red\" line"` + "\n" +
+				`ts="" stream=stderr name=test pid=42 seq=2 msg=""` + "\n",
+		},
+	} {
+		t.Run(tc.format, func(t *testing.T) {
+			var buf bytes.Buffer
+			r := &recorder{format: tc.format, name: "test"}
+			r.setPid(42)
+			w := &recordWriter{Writer: &buf, recorder: r, stream: "stderr"}
+			for _, line := range []string{"a \"\033[31mred\033[m\" line\n", "\n"} {
+				if _, err := io.WriteString(w, line); err != nil {
+					t.Fatal(err)
+				}
+			}
+			got := tc.ts.ReplaceAllStringFunc(buf.String(), func(s string) string {
+				return s[:strings.IndexAny(s, ":=")+1] + `""`
+			})
+			if tc.exp != got {
+				t.Errorf("\n-%s\n+%s", tc.exp, got)
+			}
+		})
+	}
+}
+
 func TestFileRotator(t *testing.T) {
 	t.Skipf("tested elsewhere")
 }
+
+func TestFileRotatorInterval(gt *testing.T) {
+	t := newCliTest(gt)
+	t.In("./testdata", func(t *cliTest) {
+		t.write("log", "old\n")
+		t.write("log.0", "older\n")
+		yesterday := time.Now().Add(-24 * time.Hour)
+		if err := os.Chtimes("log", yesterday, yesterday); err != nil {
+			t.Fatal(err)
+		}
+
+		every, _ := parseInterval("daily")
+		w, err := newFileRotator("log", rotateOpts{maxCount: 2, every: every})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"new\n", "newer\n"} {
+			if _, err := io.WriteString(w, line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for file, exp := range map[string]string{
+			"log":   "new\nnewer\n",
+			"log.0": "old\n",
+			"log.1": "older\n",
+		} {
+			if got := t.read(file); exp != got {
+				t.Errorf("\n%s: -%q +%q", file, exp, got)
+			}
+		}
+	})
+}
+
+func TestFileRotatorDateSuffix(gt *testing.T) {
+	t := newCliTest(gt)
+	t.In("./testdata", func(t *cliTest) {
+		t.write("log.2021-02-16T12-00-00", "A")
+		t.write("log.2021-02-16T12-00-00-1", "B")
+		var gz bytes.Buffer
+		if err := compressors["gzip"].fn(&gz, strings.NewReader("C")); err != nil {
+			t.Fatal(err)
+		}
+		t.write("log.2021-02-17T08-30-00.gz", gz.String())
+
+		w, err := newFileRotator("log", rotateOpts{
+			maxSize:  4,
+			maxCount: 3,
+			suffix:   suffixDate,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, line := range []string{"abc\n", "def\n"} {
+			if _, err := io.WriteString(w, line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		// The oldest file is dropped, the others are left untouched.
+		if t.exists("log.2021-02-16T12-00-00") {
+			t.Error("\nexpected oldest logfile to be dropped")
+		}
+		fs := w.files()
+		if exp, got := 3, len(fs); exp != got {
+			t.Fatalf("\nfile count: -%d +%d", exp, got)
+		}
+		for i, exp := range []string{"abc\n", "C", "B"} {
+			if got := t.read(fs[i].path); exp != got {
+				t.Errorf("\n%s: -%q +%q", fs[i].path, exp, got)
+			}
+		}
+		if exp, got := "def\n", t.read("log"); exp != got {
+			t.Errorf("\nlog: -%q +%q", exp, got)
+		}
+	})
+}
+
+func TestFileRotatorMaxAge(gt *testing.T) {
+	t := newCliTest(gt)
+	t.In("./testdata", func(t *cliTest) {
+		t.write("log.0", "A")
+		t.write("log.1", "B")
+		t.write("log.2", "C")
+		old := time.Now().Add(-3 * 24 * time.Hour)
+		for _, file := range []string{"log.1", "log.2"} {
+			if err := os.Chtimes(file, old, old); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		w, err := newFileRotator("log", rotateOpts{
+			maxSize: 4,
+			maxAge:  2 * 24 * time.Hour,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		t.register("log")
+
+		// Expired logfiles are dropped at startup.
+		for file, exp := range map[string]bool{
+			"log.0": true,
+			"log.1": false,
+			"log.2": false,
+		} {
+			if got := t.exists(file); exp != got {
+				t.Errorf("\n%s exists: -%t +%t", file, exp, got)
+			}
+		}
+	})
+}
+
+func TestFileRotatorStaleCompression(gt *testing.T) {
+	t := newCliTest(gt)
+	t.In("./testdata", func(t *cliTest) {
+		t.write("log.0", "A")
+		t.write("log.1.gz.tmp", "B")
+		t.write("other.0.gz.tmp", "C")
+
+		w, err := newFileRotator("log", rotateOpts{maxSize: 4, maxCount: 2, compress: "gzip"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer w.Close()
+		t.register("log")
+
+		// Leftovers of interrupted compression jobs are dropped at startup.
+		for file, exp := range map[string]bool{
+			"log.0":          true,
+			"log.1.gz.tmp":   false,
+			"other.0.gz.tmp": true,
+		} {
+			if got := t.exists(file); exp != got {
+				t.Errorf("\n%s exists: -%t +%t", file, exp, got)
+			}
+		}
+	})
+}
+
+func TestFileRotatorRender(gt *testing.T) {
+	t := newCliTest(gt)
+	t.In("./testdata", func(t *cliTest) {
+		for _, path := range []string{"a", "b", "a/log", "a/log.0", "b/log"} {
+			t.register(path)
+		}
+		w, err := newFileRotator(filepath.FromSlash("a/log"), rotateOpts{maxSize: 4, maxCount: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths := []string{"a/log", "b/log"}
+		w.render = func() (path string, _ error) {
+			path, paths = paths[0], paths[1:]
+			return filepath.FromSlash(path), nil
+		}
+		for _, line := range []string{"abc\n", "def\n", "ghi\n"} {
+			if _, err := io.WriteString(w, line); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for file, exp := range map[string]string{
+			"a/log.0": "abc\n",
+			"a/log":   "def\n",
+			"b/log":   "ghi\n",
+		} {
+			if got := t.read(file); exp != got {
+				t.Errorf("\n%s: -%q +%q", file, exp, got)
+			}
+		}
+	})
+}
+
+func TestLogfileReopen(gt *testing.T) {
+	defer func(d time.Duration) { logfileCheckInterval = d }(logfileCheckInterval)
+	logfileCheckInterval = 0
+
+	t := newCliTest(gt)
+	t.In("./testdata", func(t *cliTest) {
+		f, err := openLogfile("log")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		write := func(s string) {
+			if _, err := io.WriteString(f, s); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Moved externally.
+		write("a\n")
+		if err := os.Rename("log", "log.moved"); err != nil {
+			t.Fatal(err)
+		}
+		write("b\n")
+
+		// Deleted externally.
+		if err := os.Remove("log"); err != nil {
+			t.Fatal(err)
+		}
+		write("c\n")
+
+		// Reopened on request.
+		write("d\n")
+		f.requestReopen()
+		write("e\n")
+
+		for file, exp := range map[string]string{
+			"log.moved": "a\n",
+			"log":       "c\nd\ne\n",
+		} {
+			if got := t.read(file); exp != got {
+				t.Errorf("\n%s: -%q +%q", file, exp, got)
+			}
+		}
+	})
+}